@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -14,6 +16,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/config"
 	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/k8s"
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
 	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/registry"
 	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/syncer"
 )
@@ -39,6 +42,7 @@ func main() {
 
 	logger.Info().
 		Str("registry", cfg.RegistryURL).
+		Int("targets", len(cfg.Targets)).
 		Strs("namespaces", cfg.Namespaces).
 		Dur("sync_period", cfg.SyncPeriod).
 		Msg("Starting image sync service")
@@ -50,31 +54,113 @@ func main() {
 	}
 	logger.Info().Msg("Kubernetes client initialized")
 
-	// Detect container runtime socket first (before creating syncer)
-	containerdSocketPath, runtimeType, err := registry.DetectContainerdSocket(cfg.ContainerdSocketPath, logger)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to detect container runtime socket")
-	}
+	// Detect container runtime first (before creating syncer)
+	runtimeInfo := detectRuntime(cfg, k8sClient, logger)
+	metrics.RuntimeInfo.WithLabelValues(string(runtimeInfo.Type), runtimeInfo.Version, runtimeInfo.Source).Set(1)
 
-	// Create registry client
-	registryClient, err := registry.NewClient(cfg.RegistryURL, cfg.RegistryUsername, cfg.RegistryPassword, containerdSocketPath, runtimeType, logger)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to create registry client")
+	kinds := make([]k8s.WorkloadKind, 0, len(cfg.WorkloadKinds))
+	for _, kind := range cfg.WorkloadKinds {
+		kinds = append(kinds, k8s.WorkloadKind(kind))
 	}
-	logger.Info().Str("runtime", string(runtimeType)).Msg("Registry client initialized")
-
-	// Create syncer
-	syncerInstance := syncer.New(cfg, k8sClient, registryClient, logger)
 
 	// Setup context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Settings shared by the clients of all target registries
+	var shared []func(*registry.Client)
+
+	// Private CAs, client certificates and plain HTTP registries, for targets and sources alike
+	registryTLS, err := registry.ParseRegistryTLS(cfg.RegistryTLS)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load registry TLS settings")
+	}
+	if len(registryTLS) > 0 {
+		shared = append(shared, func(c *registry.Client) {
+			if err := c.SetRegistryTLS(registryTLS); err != nil {
+				logger.Fatal().Err(err).Msg("Failed to load registry TLS settings")
+			}
+		})
+		logger.Info().Int("registries", len(registryTLS)).Msg("Registry TLS settings loaded")
+	}
+
+	// Pull from source registries with their own credentials, never a target's
+	if cfg.SourceRegistryConfig != "" {
+		keychain, err := registry.NewConfigFileKeychain(cfg.SourceRegistryConfig)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load source registry credentials")
+		}
+		shared = append(shared, func(c *registry.Client) { c.SetSourceKeychain(keychain) })
+		logger.Info().Str("path", cfg.SourceRegistryConfig).Msg("Source registry credentials loaded")
+	}
+
+	// Pull external images with the same imagePullSecrets the workloads using them have
+	if cfg.UseImagePullSecrets {
+		resolver := k8sClient.NewPullSecretKeychains(cfg.Namespaces, kinds)
+		if err := resolver.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to watch image pull secrets of workloads")
+		}
+		shared = append(shared, func(c *registry.Client) { c.SetSourceKeychainResolver(resolver) })
+		logger.Info().Msg("Image pull secrets of workloads are used for source registries")
+	}
+
+	// Verify target content against running images and report drift as events on this pod
+	if cfg.PodName != "" {
+		recorder := k8sClient.NewPodEventRecorder(cfg.PodNamespace, cfg.PodName, cfg.NodeName)
+		shared = append(shared, func(c *registry.Client) { c.SetEventRecorder(recorder) })
+	}
+
+	// Repin workloads whose digest a restore could not reproduce
+	if cfg.RecoveryMode != "off" {
+		recoverer := k8sClient.NewWorkloadRecovery(cfg.Namespaces, kinds, k8s.RecoveryMode(cfg.RecoveryMode), cfg.NodeName)
+		if err := recoverer.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to watch workloads for recovery")
+		}
+		shared = append(shared, func(c *registry.Client) { c.SetWorkloadRecoverer(recoverer) })
+		logger.Info().Str("mode", cfg.RecoveryMode).Msg("Workload recovery enabled")
+	}
+
+	// Coordinate restores so each missing image is pushed by a single node
+	if cfg.CoordinationEnabled {
+		coordinator := k8sClient.NewLeaseCoordinator(cfg.PodNamespace, cfg.NodeName, cfg.LeaseDuration)
+		shared = append(shared, func(c *registry.Client) { c.SetRestoreCoordinator(coordinator) })
+		logger.Info().
+			Str("namespace", cfg.PodNamespace).
+			Str("identity", cfg.NodeName).
+			Dur("lease_duration", cfg.LeaseDuration).
+			Msg("Restore coordination enabled")
+	}
+
+	// Create a registry client for every target registry; they share one container runtime connection
+	targets := make([]syncer.Target, 0, len(cfg.Targets))
+	var runtimeClient *registry.Client
+	for _, target := range cfg.Targets {
+		registryClient := newRegistryClient(cfg, target, runtimeInfo, runtimeClient, logger)
+		if runtimeClient == nil {
+			runtimeClient = registryClient
+			defer runtimeClient.Close()
+		}
+		for _, apply := range shared {
+			apply(registryClient)
+		}
+		targets = append(targets, syncer.Target{
+			Name:        target.Name,
+			Client:      registryClient,
+			Concurrency: target.Concurrency,
+		})
+	}
+
+	// Create syncer
+	syncerInstance := syncer.New(cfg, k8sClient, targets, logger)
+
 	// Start metrics server
 	go startMetricsServer(cfg.MetricsAddr, logger)
 
 	// Start health server
-	go startHealthServer(cfg.HealthAddr, logger)
+	go startHealthServer(cfg.HealthAddr, runtimeInfo, logger)
+
+	// Start inventory server; every client reads the same container runtime
+	go startInventoryServer(cfg.InventoryAddr, cfg.InventoryTimeout, targets[0].Client, logger)
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -103,6 +189,52 @@ func main() {
 	logger.Info().Msg("Shutdown complete")
 }
 
+// newRegistryClient creates the client that mirrors images to one target registry. It connects to
+// the container runtime unless runtimeClient already did, in which case it shares that connection.
+func newRegistryClient(cfg *config.Config, target config.Target, runtimeInfo registry.RuntimeInfo, runtimeClient *registry.Client, logger zerolog.Logger) *registry.Client {
+	logger = logger.With().Str("target", target.Name).Logger()
+
+	var registryClient *registry.Client
+	var err error
+	if runtimeClient != nil {
+		registryClient, err = runtimeClient.NewTargetClient(target.URL, target.Username, target.Password, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create registry client")
+		}
+	} else {
+		registryClient, err = registry.NewClient(target.URL, target.Username, target.Password, runtimeInfo.SocketPath, runtimeInfo.Type, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create registry client")
+		}
+		registryClient.SetContainerdNamespaces(cfg.ContainerdNamespaces)
+		if err := registryClient.SetContainersStoragePath(cfg.ContainersStoragePath); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to open containers/storage, set crio.enabled in the chart on CRI-O nodes")
+		}
+	}
+	registryClient.SetVerifyMode(registry.VerifyMode(cfg.VerifyMode))
+
+	// Place source repositories in the target registry by its own rules
+	mappingRules, err := registry.ParseMappingRules(target.MappingRules)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load mapping rules")
+	}
+	registryClient.SetMappingRules(mappingRules)
+
+	// Images on these hosts are restored from the container runtime instead of copied
+	if err := registryClient.SetOwnedRegistries(target.OwnedRegistries); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load owned registries")
+	}
+
+	logger.Info().
+		Str("registry", target.URL).
+		Str("runtime", string(runtimeInfo.Type)).
+		Int("concurrency", target.Concurrency).
+		Int("mapping_rules", len(mappingRules)).
+		Strs("owned_registries", registryClient.OwnedRegistries()).
+		Msg("Registry client initialized")
+	return registryClient
+}
+
 // startMetricsServer starts the Prometheus metrics HTTP server
 func startMetricsServer(addr string, logger zerolog.Logger) {
 	mux := http.NewServeMux()
@@ -122,8 +254,41 @@ func startMetricsServer(addr string, logger zerolog.Logger) {
 	}
 }
 
+// detectRuntime identifies the node's container runtime by probing its socket,
+// falling back to the runtime the kubelet reports in the node status
+func detectRuntime(cfg *config.Config, k8sClient *k8s.Client, logger zerolog.Logger) registry.RuntimeInfo {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	runtimeInfo, err := registry.DetectRuntime(ctx, cfg.ContainerdSocketPath, logger)
+	if err == nil {
+		return runtimeInfo
+	}
+	if !errors.Is(err, registry.ErrRuntimeUnidentified) || cfg.NodeName == "" {
+		logger.Fatal().Err(err).Msg("Failed to detect container runtime")
+	}
+
+	logger.Warn().Err(err).Msg("Container runtime did not answer, using the runtime reported in the node status")
+	version, nodeErr := k8sClient.NodeRuntimeVersion(ctx, cfg.NodeName)
+	if nodeErr != nil {
+		logger.Fatal().Err(nodeErr).Msg("Failed to detect container runtime")
+	}
+	runtimeInfo, err = registry.RuntimeFromNodeStatus(runtimeInfo.SocketPath, version)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to detect container runtime")
+	}
+
+	logger.Info().
+		Str("socket", runtimeInfo.SocketPath).
+		Str("runtime", string(runtimeInfo.Type)).
+		Str("version", runtimeInfo.Version).
+		Str("source", runtimeInfo.Source).
+		Msg("Detected container runtime")
+	return runtimeInfo
+}
+
 // startHealthServer starts the health check HTTP server
-func startHealthServer(addr string, logger zerolog.Logger) {
+func startHealthServer(addr string, runtimeInfo registry.RuntimeInfo, logger zerolog.Logger) {
 	mux := http.NewServeMux()
 
 	// Liveness probe
@@ -138,6 +303,14 @@ func startHealthServer(addr string, logger zerolog.Logger) {
 		fmt.Fprintf(w, "Ready")
 	})
 
+	// Detected container runtime
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"runtime": runtimeInfo}); err != nil {
+			logger.Error().Err(err).Msg("Failed to write status")
+		}
+	})
+
 	server := &http.Server{
 		Addr:         addr,
 		Handler:      mux,
@@ -151,3 +324,43 @@ func startHealthServer(addr string, logger zerolog.Logger) {
 		logger.Error().Err(err).Msg("Health server error")
 	}
 }
+
+// startInventoryServer serves the node's local image inventory. Listing inspects every image
+// of the runtime, so it runs apart from the probes with its own, longer timeout.
+func startInventoryServer(addr string, timeout time.Duration, inventory *registry.Client, logger zerolog.Logger) {
+	mux := http.NewServeMux()
+
+	// Images held by the node's container runtime, with garbage-collected content
+	mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		images, err := inventory.LocalImages(ctx)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to list local images")
+			status := http.StatusInternalServerError
+			if errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusGatewayTimeout
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{"images": images}); err != nil {
+			logger.Error().Err(err).Msg("Failed to write local images")
+		}
+	})
+
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: timeout + 10*time.Second,
+		IdleTimeout:  15 * time.Second,
+	}
+
+	logger.Info().Str("addr", addr).Dur("timeout", timeout).Msg("Starting inventory server")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error().Err(err).Msg("Inventory server error")
+	}
+}
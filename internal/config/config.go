@@ -3,15 +3,28 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/registry"
 )
 
 // Config holds all configuration for the application
 type Config struct {
 	// Kubernetes configuration
-	Namespaces  []string
-	Deployments []string
+	Namespaces    []string
+	Deployments   []string
+	WorkloadKinds []string
+	DiscoveryMode string
+
+	// Node this replica runs on (downward API) and whether to restrict discovery to it
+	NodeName      string
+	NodeLocalOnly bool
+
+	// Restore coordination across nodes
+	CoordinationEnabled bool
+	LeaseDuration       time.Duration
 
 	// Target registry configuration
 	RegistryURL          string
@@ -19,32 +32,124 @@ type Config struct {
 	RegistryPassword     string
 	ContainerdSocketPath string
 
+	// All registries images are mirrored to, the primary target registry first
+	Targets []Target
+
+	// Ordered JSON list of rules mapping source repositories into the target registry
+	MappingRules string
+
+	// JSON object of TLS settings keyed by registry host, for target and source registries
+	RegistryTLS string
+
+	// Docker config.json with per-host credentials for source registries
+	SourceRegistryConfig string
+
+	// Whether source registries are also accessed with the imagePullSecrets of the workloads using an image
+	UseImagePullSecrets bool
+
+	// containerd namespaces searched, in order, for images to restore
+	ContainerdNamespaces []string
+
+	// Where the host's containers/storage is mounted, used to export CRI-O images
+	ContainersStoragePath string
+
+	// How target content is verified against running images
+	VerifyMode string
+
+	// What happens to workloads pinned to a digest that a restore could not reproduce
+	RecoveryMode string
+
+	// Syncer pod identity (downward API), used for Leases and Kubernetes events
+	PodName      string
+	PodNamespace string
+
 	// Server settings
 	MetricsAddr string
 	HealthAddr  string
 	LogLevel    string
 
+	// Local image inventory server; listing images can take long on nodes with many images
+	InventoryAddr    string
+	InventoryTimeout time.Duration
+
 	// Sync settings
-	SyncPeriod time.Duration
-	RetryDelay time.Duration
+	SyncPeriod        time.Duration
+	RetryDelay        time.Duration
+	WatchEnabled      bool
+	WatchPullFailures bool
 
 	// Retry settings
 	MaxRetries int
 }
 
+// Target is a registry images are mirrored to
+type Target struct {
+	Name     string
+	URL      string
+	Username string
+	Password string
+	// Ordered JSON list of rules mapping source repositories into this registry
+	MappingRules string
+	// How many images are synced to this registry at the same time
+	Concurrency int
+	// Other registry hosts, e.g. aliases or host:port forms, whose images are restored into this registry
+	OwnedRegistries []string
+}
+
+// primaryTargetName names the target configured by the TARGET_REGISTRY_* variables
+const primaryTargetName = "primary"
+
 // Load loads configuration from environment variables
 func Load() (*Config, error) {
 	cfg := &Config{
-		RegistryURL:          getEnv("TARGET_REGISTRY_URL", ""),
-		RegistryUsername:     getEnv("TARGET_REGISTRY_USERNAME", ""),
-		RegistryPassword:     getEnv("TARGET_REGISTRY_PASSWORD", ""),
-		MaxRetries:           3,
-		RetryDelay:           10 * time.Second,
-		MetricsAddr:          getEnv("METRICS_ADDR", ":8080"),
-		HealthAddr:           getEnv("HEALTH_ADDR", ":8081"),
-		LogLevel:             getEnv("LOG_LEVEL", "info"),
-		ContainerdSocketPath: getEnv("CONTAINERD_SOCKET_PATH", ""),
+		RegistryURL:           getEnv("TARGET_REGISTRY_URL", ""),
+		RegistryUsername:      getEnv("TARGET_REGISTRY_USERNAME", ""),
+		RegistryPassword:      getEnv("TARGET_REGISTRY_PASSWORD", ""),
+		MaxRetries:            3,
+		RetryDelay:            10 * time.Second,
+		MetricsAddr:           getEnv("METRICS_ADDR", ":8080"),
+		HealthAddr:            getEnv("HEALTH_ADDR", ":8081"),
+		InventoryAddr:         getEnv("INVENTORY_ADDR", ":8082"),
+		LogLevel:              getEnv("LOG_LEVEL", "info"),
+		ContainerdSocketPath:  getEnv("CONTAINERD_SOCKET_PATH", ""),
+		DiscoveryMode:         strings.ToLower(getEnv("DISCOVERY_MODE", "workloads")),
+		NodeName:              getEnv("NODE_NAME", ""),
+		PodNamespace:          getEnv("POD_NAMESPACE", "kube-system"),
+		VerifyMode:            strings.ToLower(getEnv("VERIFY_MODE", "report")),
+		PodName:               getEnv("POD_NAME", ""),
+		ContainersStoragePath: getEnv("CONTAINERS_STORAGE_PATH", "/host/var/lib/containers/storage"),
+		RecoveryMode:          strings.ToLower(getEnv("RECOVERY_MODE", "off")),
+		SourceRegistryConfig:  getEnv("SOURCE_REGISTRY_CONFIG", ""),
+		MappingRules:          getEnv("MAPPING_RULES", ""),
+		RegistryTLS:           getEnv("REGISTRY_TLS", ""),
+	}
+
+	// Parse use of workload image pull secrets
+	useImagePullSecrets, err := strconv.ParseBool(getEnv("USE_IMAGE_PULL_SECRETS", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid USE_IMAGE_PULL_SECRETS: %w", err)
+	}
+	cfg.UseImagePullSecrets = useImagePullSecrets
+
+	// Parse node-local discovery
+	nodeLocalOnly, err := strconv.ParseBool(getEnv("NODE_LOCAL_ONLY", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NODE_LOCAL_ONLY: %w", err)
 	}
+	cfg.NodeLocalOnly = nodeLocalOnly
+
+	// Parse restore coordination
+	coordinationEnabled, err := strconv.ParseBool(getEnv("COORDINATION_ENABLED", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid COORDINATION_ENABLED: %w", err)
+	}
+	cfg.CoordinationEnabled = coordinationEnabled
+
+	leaseDuration, err := time.ParseDuration(getEnv("RESTORE_LEASE_DURATION", "2m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RESTORE_LEASE_DURATION: %w", err)
+	}
+	cfg.LeaseDuration = leaseDuration
 
 	// Parse namespaces
 	namespacesStr := getEnv("NAMESPACES", "")
@@ -55,6 +160,13 @@ func Load() (*Config, error) {
 		}
 	}
 
+	// Parse containerd namespaces
+	for _, ns := range strings.Split(getEnv("CONTAINERD_NAMESPACES", "k8s.io"), ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			cfg.ContainerdNamespaces = append(cfg.ContainerdNamespaces, ns)
+		}
+	}
+
 	// Parse deployments (optional)
 	deploymentsStr := getEnv("DEPLOYMENTS", "")
 	if deploymentsStr != "" {
@@ -64,6 +176,20 @@ func Load() (*Config, error) {
 		}
 	}
 
+	// Parse workload kinds
+	kindsStr := getEnv("WORKLOAD_KINDS", strings.Join(supportedWorkloadKinds, ","))
+	for _, kind := range strings.Split(kindsStr, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		canonical, ok := canonicalWorkloadKind(kind)
+		if !ok {
+			return nil, fmt.Errorf("invalid WORKLOAD_KINDS: unsupported kind %q", kind)
+		}
+		cfg.WorkloadKinds = append(cfg.WorkloadKinds, canonical)
+	}
+
 	// Parse sync period
 	syncPeriodStr := getEnv("SYNC_PERIOD", "10m")
 	syncPeriod, err := time.ParseDuration(syncPeriodStr)
@@ -72,6 +198,32 @@ func Load() (*Config, error) {
 	}
 	cfg.SyncPeriod = syncPeriod
 
+	inventoryTimeout, err := time.ParseDuration(getEnv("INVENTORY_TIMEOUT", "2m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid INVENTORY_TIMEOUT: %w", err)
+	}
+	cfg.InventoryTimeout = inventoryTimeout
+
+	// Parse watch mode
+	watchEnabled, err := strconv.ParseBool(getEnv("WATCH_ENABLED", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WATCH_ENABLED: %w", err)
+	}
+	cfg.WatchEnabled = watchEnabled
+
+	watchPullFailures, err := strconv.ParseBool(getEnv("WATCH_PULL_FAILURES", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WATCH_PULL_FAILURES: %w", err)
+	}
+	cfg.WatchPullFailures = watchPullFailures
+
+	// Parse target registries: the primary one, then any additional ones by name
+	targets, err := loadTargets(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Targets = targets
+
 	// Validate required fields
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -91,18 +243,169 @@ func (c *Config) Validate() error {
 	if c.RegistryPassword == "" {
 		return fmt.Errorf("TARGET_REGISTRY_PASSWORD is required")
 	}
+	seen := make(map[string]string, len(c.Targets))
+	owners := make(map[string]string)
+	for _, target := range c.Targets {
+		for _, entry := range target.OwnedRegistries {
+			entryHost, _, _ := strings.Cut(entry, "=")
+			host, err := registry.NormalizeRegistryHost(entryHost)
+			if err != nil {
+				return fmt.Errorf("owned registries of target %s: %w", target.Name, err)
+			}
+			if other, ok := owners[host]; ok && other != target.Name {
+				return fmt.Errorf("registry %s is owned by both targets %s and %s", host, other, target.Name)
+			}
+			owners[host] = target.Name
+		}
+		if target.Name != primaryTargetName {
+			prefix := targetEnvPrefix(target.Name)
+			if target.URL == "" || target.Username == "" || target.Password == "" {
+				return fmt.Errorf("%sURL, %sUSERNAME and %sPASSWORD are required for target %s", prefix, prefix, prefix, target.Name)
+			}
+		}
+		if target.Concurrency < 1 {
+			return fmt.Errorf("concurrency of target %s must be at least 1", target.Name)
+		}
+		url, err := targetRegistry(target.URL)
+		if err != nil {
+			return fmt.Errorf("registry of target %s: %w", target.Name, err)
+		}
+		if other, ok := seen[url]; ok {
+			return fmt.Errorf("targets %s and %s both use registry %s", other, target.Name, url)
+		}
+		seen[url] = target.Name
+	}
 	if len(c.Namespaces) == 0 {
 		return fmt.Errorf("NAMESPACES is required")
 	}
+	if len(c.ContainerdNamespaces) == 0 {
+		return fmt.Errorf("CONTAINERD_NAMESPACES must contain at least one namespace")
+	}
+	if len(c.WorkloadKinds) == 0 {
+		return fmt.Errorf("WORKLOAD_KINDS must contain at least one kind")
+	}
+	switch c.DiscoveryMode {
+	case "workloads", "pods", "all":
+	default:
+		return fmt.Errorf("DISCOVERY_MODE must be one of workloads, pods, all")
+	}
+	if c.NodeLocalOnly && c.NodeName == "" {
+		return fmt.Errorf("NODE_NAME is required when NODE_LOCAL_ONLY is enabled")
+	}
+	if c.CoordinationEnabled && c.NodeName == "" {
+		return fmt.Errorf("NODE_NAME is required when COORDINATION_ENABLED is set")
+	}
+	if c.CoordinationEnabled && c.LeaseDuration < 3*time.Second {
+		return fmt.Errorf("RESTORE_LEASE_DURATION must be at least 3s")
+	}
+	switch c.VerifyMode {
+	case "off", "report", "repair":
+	default:
+		return fmt.Errorf("VERIFY_MODE must be one of off, report, repair")
+	}
+	switch c.RecoveryMode {
+	case "off", "patch", "emit":
+	default:
+		return fmt.Errorf("RECOVERY_MODE must be one of off, patch, emit")
+	}
 	if c.SyncPeriod <= 0 {
 		return fmt.Errorf("SYNC_PERIOD must be positive")
 	}
+	if c.InventoryTimeout <= 0 {
+		return fmt.Errorf("INVENTORY_TIMEOUT must be positive")
+	}
 	return nil
 }
 
+// loadTargets reads the primary target from the top-level settings and each additional target
+// named in TARGET_REGISTRIES from its TARGET_REGISTRY_<NAME>_* variables
+func loadTargets(cfg *Config) ([]Target, error) {
+	concurrency, err := strconv.Atoi(getEnv("TARGET_REGISTRY_CONCURRENCY", "5"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TARGET_REGISTRY_CONCURRENCY: %w", err)
+	}
+	targets := []Target{{
+		Name:            primaryTargetName,
+		URL:             cfg.RegistryURL,
+		Username:        cfg.RegistryUsername,
+		Password:        cfg.RegistryPassword,
+		MappingRules:    cfg.MappingRules,
+		Concurrency:     concurrency,
+		OwnedRegistries: splitList(getEnv("TARGET_REGISTRY_OWNED", "")),
+	}}
+
+	for _, name := range splitList(getEnv("TARGET_REGISTRIES", "")) {
+		if name == primaryTargetName {
+			return nil, fmt.Errorf("invalid TARGET_REGISTRIES: %q names the primary target", name)
+		}
+
+		prefix := targetEnvPrefix(name)
+		concurrency, err := strconv.Atoi(getEnv(prefix+"CONCURRENCY", "5"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sCONCURRENCY: %w", prefix, err)
+		}
+		targets = append(targets, Target{
+			Name:            name,
+			URL:             getEnv(prefix+"URL", ""),
+			Username:        getEnv(prefix+"USERNAME", ""),
+			Password:        getEnv(prefix+"PASSWORD", ""),
+			MappingRules:    getEnv(prefix+"MAPPING_RULES", ""),
+			Concurrency:     concurrency,
+			OwnedRegistries: splitList(getEnv(prefix+"OWNED", "")),
+		})
+	}
+	return targets, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// targetEnvPrefix returns the prefix of the variables configuring an additional target, e.g. TARGET_REGISTRY_DR_
+func targetEnvPrefix(name string) string {
+	return "TARGET_REGISTRY_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// supportedWorkloadKinds lists the pod-template-bearing kinds that can be discovered
+var supportedWorkloadKinds = []string{"Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job", "CronJob"}
+
+// canonicalWorkloadKind matches a kind name case-insensitively against supportedWorkloadKinds
+func canonicalWorkloadKind(kind string) (string, bool) {
+	for _, k := range supportedWorkloadKinds {
+		if strings.EqualFold(k, kind) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+// targetRegistry returns a target registry URL (host with an optional repository path) with its host
+// spelled the way image references spell it, so that e.g. "docker.io/org" and "index.docker.io/org"
+// are the same registry
+func targetRegistry(url string) (string, error) {
+	url = strings.TrimSpace(url)
+	url = strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://")
+	host, path, _ := strings.Cut(strings.TrimSuffix(url, "/"), "/")
+	host, err := registry.NormalizeRegistryHost(host)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return host, nil
+	}
+	return host + "/" + path, nil
+}
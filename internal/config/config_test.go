@@ -0,0 +1,120 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig returns a valid configuration mirroring to the given targets
+func testConfig(targets ...Target) *Config {
+	return &Config{
+		RegistryURL:          targets[0].URL,
+		RegistryUsername:     targets[0].Username,
+		RegistryPassword:     targets[0].Password,
+		Targets:              targets,
+		Namespaces:           []string{"default"},
+		ContainerdNamespaces: []string{"k8s.io"},
+		WorkloadKinds:        []string{"Deployment"},
+		DiscoveryMode:        "workloads",
+		VerifyMode:           "report",
+		RecoveryMode:         "off",
+		SyncPeriod:           10 * time.Minute,
+		InventoryTimeout:     2 * time.Minute,
+	}
+}
+
+// testTarget returns a target with credentials
+func testTarget(name, url string, owned ...string) Target {
+	return Target{Name: name, URL: url, Username: "user", Password: "password", Concurrency: 1, OwnedRegistries: owned}
+}
+
+func TestValidateTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []Target
+		wantErr string
+	}{
+		{
+			name:    "distinct registries",
+			targets: []Target{testTarget("primary", "registry.lab"), testTarget("dr", "dr.registry.lab")},
+		},
+		{
+			name:    "same host with another path",
+			targets: []Target{testTarget("primary", "registry.lab/mirror"), testTarget("dr", "registry.lab/dr")},
+		},
+		{
+			name:    "same host with another port",
+			targets: []Target{testTarget("primary", "registry.lab"), testTarget("dr", "registry.lab:5000")},
+		},
+		{
+			name:    "same URL",
+			targets: []Target{testTarget("primary", "registry.lab"), testTarget("dr", "registry.lab")},
+			wantErr: "targets primary and dr both use registry registry.lab",
+		},
+		{
+			name:    "Docker Hub under both of its names",
+			targets: []Target{testTarget("primary", "docker.io/org"), testTarget("dr", "index.docker.io/org")},
+			wantErr: "both use registry index.docker.io/org",
+		},
+		{
+			name:    "scheme, case and trailing slash",
+			targets: []Target{testTarget("primary", "registry.lab/mirror"), testTarget("dr", "https://Registry.lab/mirror/")},
+			wantErr: "both use registry registry.lab/mirror",
+		},
+		{
+			name: "owned hosts of different targets",
+			targets: []Target{
+				testTarget("primary", "registry.lab", "registry.internal:5000=internal"),
+				testTarget("dr", "dr.registry.lab", "registry.internal"),
+			},
+		},
+		{
+			name: "owned host listed twice by one target",
+			targets: []Target{
+				testTarget("primary", "registry.lab", "registry.internal", "https://Registry.Internal/=team"),
+			},
+		},
+		{
+			name: "owned host of two targets",
+			targets: []Target{
+				testTarget("primary", "registry.lab", "registry.internal=internal"),
+				testTarget("dr", "dr.registry.lab", "Registry.Internal/"),
+			},
+			wantErr: "registry registry.internal is owned by both targets primary and dr",
+		},
+		{
+			name: "Docker Hub owned under both of its names",
+			targets: []Target{
+				testTarget("primary", "registry.lab", "docker.io"),
+				testTarget("dr", "dr.registry.lab", "index.docker.io"),
+			},
+			wantErr: "registry index.docker.io is owned by both targets",
+		},
+		{
+			name:    "invalid owned host",
+			targets: []Target{testTarget("primary", "registry.lab", "registry.internal/team")},
+			wantErr: "owned registries of target primary",
+		},
+		{
+			name:    "invalid registry host",
+			targets: []Target{testTarget("primary", "registry.lab"), testTarget("dr", "registry lab")},
+			wantErr: "registry of target dr",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testConfig(tt.targets...).Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,10 +3,11 @@ package k8s
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/rs/zerolog"
-	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -14,8 +15,12 @@ import (
 
 // Client wraps Kubernetes client
 type Client struct {
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
 	logger    zerolog.Logger
+
+	mu sync.Mutex
+	// factories are the shared informer factories per namespace, and per node for node-local pods
+	factories map[factoryKey]informers.SharedInformerFactory
 }
 
 // NewClient creates a new Kubernetes client
@@ -43,33 +48,53 @@ func NewClient(logger zerolog.Logger) (*Client, error) {
 	}, nil
 }
 
-// GetDeploymentImages returns all container images used in deployments
-func (c *Client) GetDeploymentImages(ctx context.Context, namespace string, deploymentNames []string) ([]string, error) {
+// GetWorkloadImages returns all container images used by workloads of the given kinds in a namespace.
+// If deploymentNames is not empty, only those Deployments are inspected; other kinds are listed in full.
+func (c *Client) GetWorkloadImages(ctx context.Context, namespace string, kinds []WorkloadKind, deploymentNames []string) ([]string, error) {
 	imageSet := make(map[string]struct{})
 
-	if len(deploymentNames) == 0 {
-		// Get all deployments in the namespace
-		deployments, err := c.clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("failed to list deployments in namespace %s: %w", namespace, err)
+	enabled := make(map[string]struct{}, len(kinds))
+	for _, kind := range kinds {
+		enabled[string(kind)] = struct{}{}
+	}
+
+	for _, kind := range kinds {
+		if kind == KindDeployment && len(deploymentNames) > 0 {
+			// Get specific deployments
+			for _, depName := range deploymentNames {
+				dep, err := c.clientset.AppsV1().Deployments(namespace).Get(ctx, depName, metav1.GetOptions{})
+				if err != nil {
+					c.logger.Error().
+						Err(err).
+						Str("namespace", namespace).
+						Str("deployment", depName).
+						Msg("Failed to get deployment")
+					continue
+				}
+				extractImagesFromPodSpec(&dep.Spec.Template.Spec, imageSet)
+			}
+			continue
 		}
 
-		for _, dep := range deployments.Items {
-			c.extractImagesFromDeployment(&dep, imageSet)
+		// A kind that cannot be listed, e.g. for lack of RBAC, must not hide the images of the others
+		workloads, err := c.listWorkloads(ctx, kind, namespace)
+		if err != nil {
+			c.logger.Error().
+				Err(err).
+				Str("namespace", namespace).
+				Str("kind", string(kind)).
+				Msg("Failed to list workloads")
+			continue
 		}
-	} else {
-		// Get specific deployments
-		for _, depName := range deploymentNames {
-			dep, err := c.clientset.AppsV1().Deployments(namespace).Get(ctx, depName, metav1.GetOptions{})
-			if err != nil {
-				c.logger.Error().
-					Err(err).
-					Str("namespace", namespace).
-					Str("deployment", depName).
-					Msg("Failed to get deployment")
+
+		for _, w := range workloads {
+			// Objects managed by another discovered controller (e.g. ReplicaSets of a
+			// Deployment, Jobs of a CronJob) are covered by their owner's template;
+			// listing them too would drag in images of stale revisions.
+			if _, ok := enabled[w.ownerKind]; ok {
 				continue
 			}
-			c.extractImagesFromDeployment(dep, imageSet)
+			extractImagesFromPodSpec(w.podSpec, imageSet)
 		}
 	}
 
@@ -82,51 +107,70 @@ func (c *Client) GetDeploymentImages(ctx context.Context, namespace string, depl
 	return images, nil
 }
 
-// extractImagesFromDeployment extracts all images from a deployment
-func (c *Client) extractImagesFromDeployment(dep *appsv1.Deployment, imageSet map[string]struct{}) {
-	// Extract from init containers
-	for _, container := range dep.Spec.Template.Spec.InitContainers {
-		if container.Image != "" {
-			imageSet[container.Image] = struct{}{}
-		}
-	}
+// GetAllImages returns all unique images from the configured namespaces.
+// Depending on the mode, images come from workload templates, from running pods, or both.
+func (c *Client) GetAllImages(ctx context.Context, opts DiscoveryOptions) ([]Image, error) {
+	imageSet := make(map[Image]struct{})
 
-	// Extract from regular containers
-	for _, container := range dep.Spec.Template.Spec.Containers {
-		if container.Image != "" {
-			imageSet[container.Image] = struct{}{}
+	for _, ns := range opts.Namespaces {
+		if opts.Mode == DiscoveryWorkloads || opts.Mode == DiscoveryAll {
+			images, err := c.GetWorkloadImages(ctx, ns, opts.Kinds, opts.Deployments)
+			if err != nil {
+				c.logger.Error().
+					Err(err).
+					Str("namespace", ns).
+					Msg("Failed to get workload images from namespace")
+			}
+			for _, image := range images {
+				imageSet[Image{Name: image}] = struct{}{}
+			}
 		}
-	}
-}
-
-// GetAllImages returns all unique images from specified namespaces and deployments
-func (c *Client) GetAllImages(ctx context.Context, namespaces []string, deployments []string) ([]string, error) {
-	imageSet := make(map[string]struct{})
 
-	for _, ns := range namespaces {
-		images, err := c.GetDeploymentImages(ctx, ns, deployments)
-		if err != nil {
-			c.logger.Error().
-				Err(err).
-				Str("namespace", ns).
-				Msg("Failed to get images from namespace")
-			continue
+		if opts.Mode == DiscoveryPods || opts.Mode == DiscoveryAll {
+			images, err := c.GetPodImages(ctx, ns, opts.NodeName)
+			if err != nil {
+				c.logger.Error().
+					Err(err).
+					Str("namespace", ns).
+					Msg("Failed to get pod images from namespace")
+			}
+			for _, image := range images {
+				imageSet[image] = struct{}{}
+			}
 		}
+	}
 
-		for _, image := range images {
-			imageSet[image] = struct{}{}
+	// An image known by digest makes its digest-less entry redundant
+	resolved := make(map[string]struct{})
+	for image := range imageSet {
+		if image.Digest != "" {
+			resolved[image.Name] = struct{}{}
 		}
 	}
 
 	// Convert to slice
-	allImages := make([]string, 0, len(imageSet))
+	allImages := make([]Image, 0, len(imageSet))
 	for image := range imageSet {
+		if _, ok := resolved[image.Name]; ok && image.Digest == "" {
+			continue
+		}
 		allImages = append(allImages, image)
 	}
 
 	c.logger.Info().
 		Int("count", len(allImages)).
+		Str("mode", string(opts.Mode)).
+		Str("node", opts.NodeName).
 		Msg("Total unique images found")
 
 	return allImages, nil
 }
+
+// NodeRuntimeVersion returns the container runtime the kubelet reports for a node, e.g. containerd://1.7.13
+func (c *Client) NodeRuntimeVersion(ctx context.Context, nodeName string) (string, error) {
+	node, err := c.clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get node %s: %w", nodeName, err)
+	}
+	return node.Status.NodeInfo.ContainerRuntimeVersion, nil
+}
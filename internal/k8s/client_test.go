@@ -0,0 +1,105 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testMeta returns object metadata in the test namespace, controlled by owner if it is set
+func testMeta(name, owner string) metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{Name: name, Namespace: "apps"}
+	if owner != "" {
+		controller := true
+		meta.OwnerReferences = []metav1.OwnerReference{{Kind: owner, Name: "owner", Controller: &controller}}
+	}
+	return meta
+}
+
+// testTemplate returns a pod template running image
+func testTemplate(image string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}}}
+}
+
+// testWorkloads returns one object of every supported kind, plus a ReplicaSet of a Deployment
+// and a Job of a CronJob
+func testWorkloads() []runtime.Object {
+	return []runtime.Object{
+		&appsv1.Deployment{ObjectMeta: testMeta("web", ""), Spec: appsv1.DeploymentSpec{Template: testTemplate("web:v1")}},
+		&appsv1.StatefulSet{ObjectMeta: testMeta("db", ""), Spec: appsv1.StatefulSetSpec{Template: testTemplate("db:v1")}},
+		&appsv1.DaemonSet{ObjectMeta: testMeta("agent", ""), Spec: appsv1.DaemonSetSpec{Template: testTemplate("agent:v1")}},
+		&appsv1.ReplicaSet{ObjectMeta: testMeta("standalone", ""), Spec: appsv1.ReplicaSetSpec{Template: testTemplate("standalone:v1")}},
+		&appsv1.ReplicaSet{ObjectMeta: testMeta("web-5d8f", "Deployment"), Spec: appsv1.ReplicaSetSpec{Template: testTemplate("web:v0")}},
+		&batchv1.Job{ObjectMeta: testMeta("migrate", ""), Spec: batchv1.JobSpec{Template: testTemplate("migrate:v1")}},
+		&batchv1.Job{ObjectMeta: testMeta("backup-2961", "CronJob"), Spec: batchv1.JobSpec{Template: testTemplate("backup:v0")}},
+		&batchv1.CronJob{ObjectMeta: testMeta("backup", ""), Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: testTemplate("backup:v1")}},
+		}},
+	}
+}
+
+func TestGetWorkloadImages(t *testing.T) {
+	allKinds := []WorkloadKind{KindDeployment, KindStatefulSet, KindDaemonSet, KindReplicaSet, KindJob, KindCronJob}
+
+	tests := []struct {
+		name        string
+		kinds       []WorkloadKind
+		deployments []string
+		failing     string
+		want        []string
+	}{
+		{
+			name:  "all kinds, owned objects covered by their owners",
+			kinds: allKinds,
+			want:  []string{"agent:v1", "backup:v1", "db:v1", "migrate:v1", "standalone:v1", "web:v1"},
+		},
+		{
+			name:  "owned objects when their owner kind is not discovered",
+			kinds: []WorkloadKind{KindReplicaSet, KindJob},
+			want:  []string{"backup:v0", "migrate:v1", "standalone:v1", "web:v0"},
+		},
+		{
+			name:        "named deployments",
+			kinds:       []WorkloadKind{KindDeployment},
+			deployments: []string{"web", "missing"},
+			want:        []string{"web:v1"},
+		},
+		{
+			name:    "a kind that cannot be listed",
+			kinds:   allKinds,
+			failing: "statefulsets",
+			want:    []string{"agent:v1", "backup:v1", "migrate:v1", "standalone:v1", "web:v1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewClientset(testWorkloads()...)
+			if tt.failing != "" {
+				clientset.PrependReactor("list", tt.failing, func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("forbidden")
+				})
+			}
+			c := &Client{clientset: clientset, logger: zerolog.Nop()}
+
+			images, err := c.GetWorkloadImages(context.Background(), "apps", tt.kinds, tt.deployments)
+			if err != nil {
+				t.Fatalf("GetWorkloadImages() error = %v", err)
+			}
+			slices.Sort(images)
+			if !slices.Equal(images, tt.want) {
+				t.Errorf("GetWorkloadImages() = %v, want %v", images, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package k8s
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventComponent is the source component of recorded events
+const eventComponent = "push-missed-images"
+
+// PodEventRecorder records Kubernetes events on the pod the syncer runs in
+type PodEventRecorder struct {
+	recorder record.EventRecorder
+	pod      *corev1.ObjectReference
+}
+
+// NewPodEventRecorder creates a recorder for events about the given syncer pod
+func (c *Client) NewPodEventRecorder(namespace, podName, nodeName string) *PodEventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: c.clientset.CoreV1().Events(namespace),
+	})
+
+	return &PodEventRecorder{
+		recorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{
+			Component: eventComponent,
+			Host:      nodeName,
+		}),
+		pod: &corev1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Namespace:  namespace,
+			Name:       podName,
+		},
+	}
+}
+
+// Event records an event of the given type ("Normal" or "Warning") on the syncer pod
+func (r *PodEventRecorder) Event(eventType, reason, message string) {
+	r.recorder.Event(r.pod, eventType, reason, message)
+}
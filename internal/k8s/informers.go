@@ -0,0 +1,137 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// informerSyncTimeout bounds how long the initial listing of a watch is waited for before it is
+// reported as not synced; the informers keep retrying in the background either way
+const informerSyncTimeout = 2 * time.Minute
+
+// factoryKey identifies a shared informer factory by namespace and, for pods, node
+type factoryKey struct {
+	namespace string
+	nodeName  string
+}
+
+// informerFactory returns the shared informer factory of a namespace, creating it on first use.
+// Every watch of a namespace uses it, so each kind of object is listed and watched only once.
+func (c *Client) informerFactory(namespace string) informers.SharedInformerFactory {
+	return c.nodeInformerFactory(namespace, "")
+}
+
+// nodeInformerFactory returns the shared informer factory of a namespace that lists only the pods
+// scheduled on nodeName, or every object if nodeName is empty. A factory of a node serves pods only.
+func (c *Client) nodeInformerFactory(namespace, nodeName string) informers.SharedInformerFactory {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.factories == nil {
+		c.factories = make(map[factoryKey]informers.SharedInformerFactory)
+	}
+	key := factoryKey{namespace: namespace, nodeName: nodeName}
+	factory, ok := c.factories[key]
+	if !ok {
+		opts := []informers.SharedInformerOption{informers.WithNamespace(namespace)}
+		if nodeName != "" {
+			opts = append(opts, informers.WithTweakListOptions(func(list *metav1.ListOptions) {
+				list.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+			}))
+		}
+		factory = informers.NewSharedInformerFactoryWithOptions(c.clientset, 0, opts...)
+		c.factories[key] = factory
+	}
+	return factory
+}
+
+// namespaceFactories returns the informer factories created so far for the given namespaces
+func (c *Client) namespaceFactories(namespaces []string) []informers.SharedInformerFactory {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var factories []informers.SharedInformerFactory
+	for key, factory := range c.factories {
+		if slices.Contains(namespaces, key.namespace) {
+			factories = append(factories, factory)
+		}
+	}
+	return factories
+}
+
+// startInformers starts the informers requested so far in the given namespaces and waits for their
+// caches in the background, so that a slow API server or a missing permission never holds up the
+// caller. Informers stop when ctx is done.
+func (c *Client) startInformers(ctx context.Context, namespaces []string, watch string) {
+	factories := c.namespaceFactories(namespaces)
+	for _, factory := range factories {
+		factory.Start(ctx.Done())
+	}
+
+	go func() {
+		syncCtx, cancel := context.WithTimeout(ctx, informerSyncTimeout)
+		defer cancel()
+
+		synced := true
+		for _, factory := range factories {
+			for informerType, ok := range factory.WaitForCacheSync(syncCtx.Done()) {
+				if !ok && ctx.Err() == nil {
+					synced = false
+					c.logger.Warn().
+						Str("watch", watch).
+						Str("informer", fmt.Sprint(informerType)).
+						Dur("timeout", informerSyncTimeout).
+						Msg("Informer cache did not sync in time, check RBAC permissions; retrying in the background")
+				}
+			}
+		}
+		if synced && ctx.Err() == nil {
+			c.logger.Info().
+				Str("watch", watch).
+				Strs("namespaces", namespaces).
+				Msg("Informer caches synced")
+		}
+	}()
+}
+
+// imageIndex indexes cached pods and workloads by the images of their containers
+const imageIndex = "image"
+
+// indexByImage makes a shared informer index its objects by container image, once
+func (c *Client) indexByImage(informer cache.SharedIndexInformer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := informer.GetIndexer().GetIndexers()[imageIndex]; ok {
+		return nil
+	}
+	return informer.AddIndexers(cache.Indexers{imageIndex: containerImages})
+}
+
+// containerImages returns the images of the containers of a cached pod or workload
+func containerImages(obj interface{}) ([]string, error) {
+	var spec *corev1.PodSpec
+	if pod, ok := obj.(*corev1.Pod); ok {
+		spec = &pod.Spec
+	} else if w, ok := workloadFromObject(obj); ok {
+		spec = w.podSpec
+	} else {
+		return nil, nil
+	}
+
+	imageSet := make(map[string]struct{})
+	extractImagesFromPodSpec(spec, imageSet)
+	images := make([]string, 0, len(imageSet))
+	for image := range imageSet {
+		images = append(images, image)
+	}
+	return images, nil
+}
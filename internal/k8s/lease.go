@@ -0,0 +1,241 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	leaseNamePrefix      = "push-missed-images-"
+	leaseImageAnnotation = "push-missed-images/image"
+)
+
+// LeaseCoordinator makes sure each missing image is restored by a single node.
+// Every restore is guarded by a per-image coordination.k8s.io Lease; a claim that
+// is not renewed (the holder crashed or its node disappeared) expires and can be
+// taken over by another node.
+type LeaseCoordinator struct {
+	clientset kubernetes.Interface
+	namespace string
+	identity  string
+	duration  time.Duration
+	logger    zerolog.Logger
+
+	mu       sync.Mutex
+	renewals map[string]context.CancelFunc
+}
+
+// NewLeaseCoordinator creates a coordinator that holds leases in namespace under the given identity
+func (c *Client) NewLeaseCoordinator(namespace, identity string, duration time.Duration) *LeaseCoordinator {
+	return &LeaseCoordinator{
+		clientset: c.clientset,
+		namespace: namespace,
+		identity:  identity,
+		duration:  duration,
+		logger:    c.logger,
+		renewals:  make(map[string]context.CancelFunc),
+	}
+}
+
+// Claim tries to become the restorer of image. It returns false if another
+// holder has a live lease for it.
+func (l *LeaseCoordinator) Claim(ctx context.Context, image string) (bool, error) {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	leaseName := leaseNameFor(image)
+	now := metav1.NewMicroTime(time.Now())
+
+	lease, err := leases.Get(ctx, leaseName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      leaseName,
+				Namespace: l.namespace,
+				Labels: map[string]string{
+					"app": "push-missed-images",
+				},
+				Annotations: map[string]string{
+					leaseImageAnnotation: image,
+				},
+			},
+			Spec: l.leaseSpec(now, 0),
+		}
+		if _, err := leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to create lease %s: %w", leaseName, err)
+		}
+	case err != nil:
+		return false, fmt.Errorf("failed to get lease %s: %w", leaseName, err)
+	default:
+		if l.heldByOther(lease, now.Time) {
+			l.logger.Debug().
+				Str("image", image).
+				Str("holder", holderOf(lease)).
+				Msg("Restore is claimed by another node")
+			return false, nil
+		}
+
+		transitions := int32(0)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions
+		}
+		if holderOf(lease) != l.identity {
+			l.logger.Info().
+				Str("image", image).
+				Str("previous_holder", holderOf(lease)).
+				Msg("Taking over expired restore lease")
+			transitions++
+		}
+		lease.Spec = l.leaseSpec(now, transitions)
+
+		// The update carries the observed resourceVersion, so two nodes racing
+		// for an expired lease cannot both win
+		if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+			if apierrors.IsConflict(err) {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to update lease %s: %w", leaseName, err)
+		}
+	}
+
+	l.startRenewal(ctx, image, leaseName)
+	return true, nil
+}
+
+// Release ends the claim on image so that another node can restore it if needed
+func (l *LeaseCoordinator) Release(ctx context.Context, image string) error {
+	leaseName := leaseNameFor(image)
+
+	l.mu.Lock()
+	if cancel, ok := l.renewals[leaseName]; ok {
+		cancel()
+		delete(l.renewals, leaseName)
+	}
+	l.mu.Unlock()
+
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, leaseName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get lease %s: %w", leaseName, err)
+	}
+	if holderOf(lease) != l.identity {
+		return nil
+	}
+
+	err = leases.Delete(ctx, leaseName, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{
+			UID:             &lease.UID,
+			ResourceVersion: &lease.ResourceVersion,
+		},
+	})
+	if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+		return fmt.Errorf("failed to delete lease %s: %w", leaseName, err)
+	}
+
+	return nil
+}
+
+// startRenewal keeps the lease alive while a long restore is in progress. Renewals stop with ctx,
+// the context of the restore, so that the lease of a cancelled restore expires.
+func (l *LeaseCoordinator) startRenewal(ctx context.Context, image, leaseName string) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	l.mu.Lock()
+	if previous, ok := l.renewals[leaseName]; ok {
+		previous()
+	}
+	l.renewals[leaseName] = cancel
+	l.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(l.duration / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := l.renew(ctx, leaseName); err != nil {
+					l.logger.Warn().
+						Err(err).
+						Str("image", image).
+						Msg("Failed to renew restore lease")
+				}
+			}
+		}
+	}()
+}
+
+// renew bumps the renew time of a lease this node holds
+func (l *LeaseCoordinator) renew(ctx context.Context, leaseName string) error {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+
+	lease, err := leases.Get(ctx, leaseName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if holderOf(lease) != l.identity {
+		return fmt.Errorf("lease %s is now held by %s", leaseName, holderOf(lease))
+	}
+
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// leaseSpec builds a lease spec held by this coordinator starting at now
+func (l *LeaseCoordinator) leaseSpec(now metav1.MicroTime, transitions int32) coordinationv1.LeaseSpec {
+	identity := l.identity
+	durationSeconds := int32(l.duration / time.Second)
+	return coordinationv1.LeaseSpec{
+		HolderIdentity:       &identity,
+		LeaseDurationSeconds: &durationSeconds,
+		AcquireTime:          &now,
+		RenewTime:            &now,
+		LeaseTransitions:     &transitions,
+	}
+}
+
+// heldByOther reports whether lease is held by a different, still live holder
+func (l *LeaseCoordinator) heldByOther(lease *coordinationv1.Lease, now time.Time) bool {
+	holder := holderOf(lease)
+	if holder == "" || holder == l.identity {
+		return false
+	}
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return now.Before(expiry)
+}
+
+// holderOf returns the holder identity of a lease, or an empty string
+func holderOf(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// leaseNameFor derives a valid, stable Lease name from an image reference
+func leaseNameFor(image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return leaseNamePrefix + hex.EncodeToString(sum[:])[:16]
+}
@@ -0,0 +1,68 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaseCoordinator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Client{clientset: fake.NewClientset(), logger: zerolog.Nop()}
+	nodeA := c.NewLeaseCoordinator("kube-system", "node-a", time.Minute)
+	nodeB := c.NewLeaseCoordinator("kube-system", "node-b", time.Minute)
+	const image = "registry.lab/org/app:v1"
+
+	if claimed, err := nodeA.Claim(ctx, image); err != nil || !claimed {
+		t.Fatalf("first Claim() = %v, %v, want true, nil", claimed, err)
+	}
+	if claimed, err := nodeB.Claim(ctx, image); err != nil || claimed {
+		t.Fatalf("Claim() of a held lease = %v, %v, want false, nil", claimed, err)
+	}
+	// The holder may claim again, e.g. from another worker
+	if claimed, err := nodeA.Claim(ctx, image); err != nil || !claimed {
+		t.Fatalf("Claim() by the holder = %v, %v, want true, nil", claimed, err)
+	}
+
+	// Release by another node leaves the lease alone
+	if err := nodeB.Release(ctx, image); err != nil {
+		t.Fatalf("Release() by another node error = %v", err)
+	}
+	if claimed, _ := nodeB.Claim(ctx, image); claimed {
+		t.Fatal("Claim() succeeded after another node released a lease it does not hold")
+	}
+
+	if err := nodeA.Release(ctx, image); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if claimed, err := nodeB.Claim(ctx, image); err != nil || !claimed {
+		t.Fatalf("Claim() after release = %v, %v, want true, nil", claimed, err)
+	}
+
+	// A lease its holder stopped renewing is taken over
+	leases := c.clientset.CoordinationV1().Leases("kube-system")
+	lease, err := leases.Get(ctx, leaseNameFor(image), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := metav1.NewMicroTime(time.Now().Add(-2 * time.Minute))
+	lease.Spec.RenewTime = &expired
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := nodeA.Claim(ctx, image); err != nil || !claimed {
+		t.Fatalf("Claim() of an expired lease = %v, %v, want true, nil", claimed, err)
+	}
+	lease, err = leases.Get(ctx, leaseNameFor(image), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holderOf(lease) != "node-a" || lease.Spec.LeaseTransitions == nil || *lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("lease after takeover is held by %q with %v transitions, want node-a with 1", holderOf(lease), lease.Spec.LeaseTransitions)
+	}
+}
@@ -0,0 +1,114 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// DiscoveryMode selects where images are discovered from
+type DiscoveryMode string
+
+const (
+	// DiscoveryWorkloads reads images from workload pod templates
+	DiscoveryWorkloads DiscoveryMode = "workloads"
+	// DiscoveryPods reads images and their resolved digests from running pods
+	DiscoveryPods DiscoveryMode = "pods"
+	// DiscoveryAll combines workload and pod discovery
+	DiscoveryAll DiscoveryMode = "all"
+)
+
+// DiscoveryOptions controls which images GetAllImages reports
+type DiscoveryOptions struct {
+	Namespaces  []string
+	Mode        DiscoveryMode
+	Kinds       []WorkloadKind
+	Deployments []string
+	// NodeName restricts pod discovery to pods scheduled on this node, if set
+	NodeName string
+}
+
+// Image is a container image discovered in the cluster
+type Image struct {
+	// Name is the image reference as written in the pod spec
+	Name string
+	// Digest is the manifest digest the kubelet resolved the image to, empty if unknown
+	Digest string
+}
+
+// GetPodImages returns the images of all active pods in a namespace together with
+// the digests reported in their container statuses. If nodeName is set, only pods
+// scheduled on that node are considered.
+func (c *Client) GetPodImages(ctx context.Context, namespace, nodeName string) ([]Image, error) {
+	opts := metav1.ListOptions{}
+	if nodeName != "" {
+		opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+	}
+
+	pods, err := c.clientset.CoreV1().Pods(namespace).List(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods in namespace %s: %w", namespace, err)
+	}
+
+	imageSet := make(map[Image]struct{})
+	for i := range pods.Items {
+		extractImagesFromPod(&pods.Items[i], imageSet)
+	}
+
+	images := make([]Image, 0, len(imageSet))
+	for image := range imageSet {
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+// extractImagesFromPod pairs each container's spec image with the digest from its status
+func extractImagesFromPod(pod *corev1.Pod, imageSet map[Image]struct{}) {
+	// Finished pods no longer hold their images on the node
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return
+	}
+
+	imageIDs := make(map[string]string)
+	for _, status := range pod.Status.InitContainerStatuses {
+		imageIDs[status.Name] = status.ImageID
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		imageIDs[status.Name] = status.ImageID
+	}
+
+	containers := make([]corev1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	containers = append(containers, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+
+	for _, container := range containers {
+		if container.Image == "" {
+			continue
+		}
+		imageSet[Image{
+			Name:   container.Image,
+			Digest: digestFromImageID(imageIDs[container.Name]),
+		}] = struct{}{}
+	}
+}
+
+// digestFromImageID extracts the manifest digest from a container status ImageID.
+// Runtimes report either "repo@sha256:..." (optionally with a docker-pullable:// scheme)
+// or a bare "sha256:..." image ID; the latter is a config digest and cannot be pulled.
+func digestFromImageID(imageID string) string {
+	imageID = strings.TrimPrefix(imageID, "docker-pullable://")
+	idx := strings.LastIndex(imageID, "@")
+	if idx < 0 {
+		return ""
+	}
+	digest := imageID[idx+1:]
+	if !strings.HasPrefix(digest, "sha256:") {
+		return ""
+	}
+	return digest
+}
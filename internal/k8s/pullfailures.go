@@ -0,0 +1,146 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// PullFailureSourcePodStatus marks failures seen in pod container statuses
+	PullFailureSourcePodStatus = "pod_status"
+	// PullFailureSourceEvent marks failures seen in kubelet events
+	PullFailureSourceEvent = "event"
+)
+
+// pullFailureReasons are the container waiting reasons of a failing image pull
+var pullFailureReasons = map[string]struct{}{
+	"ErrImagePull":     {},
+	"ImagePullBackOff": {},
+}
+
+// pullEventImage matches the image in kubelet events such as
+// `Failed to pull image "registry/app:1.0": ...` and `Back-off pulling image "registry/app:1.0"`
+var pullEventImage = regexp.MustCompile(`(?:[Ff]ailed to pull|[Bb]ack-off pulling) image "([^"]+)"`)
+
+// PullFailureHandler receives an image that a pod failed to pull and where the failure was seen
+type PullFailureHandler func(image Image, source string)
+
+// WatchPullFailures watches pods and kubelet events in the given namespaces and calls
+// handler for every image that fails with ErrImagePull or ImagePullBackOff.
+// Pods on all nodes are watched: the failing pod usually runs on a node that does
+// not hold the image, while the nodes that do hold it must react.
+// It returns once the shared informers are started; their caches sync in the background
+// and informers stop when ctx is done.
+func (c *Client) WatchPullFailures(ctx context.Context, namespaces []string, handler PullFailureHandler) error {
+	for _, ns := range namespaces {
+		factory := c.informerFactory(ns)
+
+		podInformer := factory.Core().V1().Pods().Informer()
+		if _, err := podInformer.AddEventHandler(pullFailurePodHandler(handler)); err != nil {
+			return fmt.Errorf("failed to watch pods in namespace %s: %w", ns, err)
+		}
+
+		eventInformer := factory.Core().V1().Events().Informer()
+		if _, err := eventInformer.AddEventHandler(pullFailureEventHandler(handler)); err != nil {
+			return fmt.Errorf("failed to watch events in namespace %s: %w", ns, err)
+		}
+	}
+
+	c.startInformers(ctx, namespaces, "pull_failures")
+
+	c.logger.Info().
+		Strs("namespaces", namespaces).
+		Msg("Watching for image pull failures")
+
+	return nil
+}
+
+// pullFailurePodHandler reports images of containers waiting on a failed pull.
+// Pod status updates that do not change a container's waiting reason are ignored,
+// so an image is reported once per failure instead of on every status update.
+func pullFailurePodHandler(handler PullFailureHandler) cache.ResourceEventHandler {
+	failuresOf := func(obj interface{}) map[pullFailure]struct{} {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			return nil
+		}
+		return failedPulls(pod)
+	}
+	report := func(oldFailures, newFailures map[pullFailure]struct{}) {
+		for failure := range newFailures {
+			if _, ok := oldFailures[failure]; !ok {
+				handler(Image{Name: failure.image}, PullFailureSourcePodStatus)
+			}
+		}
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			report(nil, failuresOf(obj))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			report(failuresOf(oldObj), failuresOf(newObj))
+		},
+	}
+}
+
+// pullFailureEventHandler reports images named in pull failure events of pods
+func pullFailureEventHandler(handler PullFailureHandler) cache.ResourceEventHandler {
+	report := func(obj interface{}) {
+		event, ok := obj.(*corev1.Event)
+		if !ok || event.Type != corev1.EventTypeWarning || event.InvolvedObject.Kind != "Pod" {
+			return
+		}
+		if match := pullEventImage.FindStringSubmatch(event.Message); match != nil {
+			handler(Image{Name: match[1]}, PullFailureSourceEvent)
+		}
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: report,
+		UpdateFunc: func(_, newObj interface{}) {
+			report(newObj)
+		},
+	}
+}
+
+// pullFailure is a container waiting on a failed pull of an image
+type pullFailure struct {
+	container string
+	image     string
+	reason    string
+}
+
+// failedPulls returns the containers of a pod stuck on a failed pull
+func failedPulls(pod *corev1.Pod) map[pullFailure]struct{} {
+	specImages := make(map[string]string)
+	for _, container := range pod.Spec.InitContainers {
+		specImages[container.Name] = container.Image
+	}
+	for _, container := range pod.Spec.Containers {
+		specImages[container.Name] = container.Image
+	}
+
+	statuses := make([]corev1.ContainerStatus, 0, len(pod.Status.InitContainerStatuses)+len(pod.Status.ContainerStatuses))
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+
+	failures := make(map[pullFailure]struct{})
+	for _, status := range statuses {
+		if status.State.Waiting == nil {
+			continue
+		}
+		if _, ok := pullFailureReasons[status.State.Waiting.Reason]; !ok {
+			continue
+		}
+		if image := specImages[status.Name]; image != "" {
+			failures[pullFailure{container: status.Name, image: image, reason: status.State.Waiting.Reason}] = struct{}{}
+		}
+	}
+
+	return failures
+}
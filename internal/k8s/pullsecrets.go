@@ -0,0 +1,179 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	k8schain "github.com/google/go-containerregistry/pkg/authn/kubernetes"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// keychainTTL is how long the keychain of a pull identity is reused before its secrets are read again
+const keychainTTL = 5 * time.Minute
+
+// pullIdentity is the set of credentials a pod pulls its images with
+type pullIdentity struct {
+	namespace      string
+	serviceAccount string
+	// secrets are the pod's imagePullSecrets, comma separated to keep the key comparable
+	secrets string
+}
+
+// cachedKeychain is the keychain of a pull identity and when its secrets have to be read again
+type cachedKeychain struct {
+	keychain authn.Keychain
+	expires  time.Time
+}
+
+// PullSecretKeychains resolves, per image, the imagePullSecrets the cluster itself pulls it with.
+// Pods and workloads using an image are looked up in the shared informer caches, and the keychain
+// of each pull identity is cached for keychainTTL.
+type PullSecretKeychains struct {
+	client     *Client
+	namespaces []string
+	kinds      []WorkloadKind
+	logger     zerolog.Logger
+
+	// informers are the pod and workload informers indexed by image
+	informers []cache.SharedIndexInformer
+
+	mu        sync.Mutex
+	keychains map[pullIdentity]cachedKeychain
+}
+
+// NewPullSecretKeychains creates a resolver for images used by workloads and pods in the given namespaces
+func (c *Client) NewPullSecretKeychains(namespaces []string, kinds []WorkloadKind) *PullSecretKeychains {
+	return &PullSecretKeychains{
+		client:     c,
+		namespaces: namespaces,
+		kinds:      kinds,
+		logger:     c.logger,
+		keychains:  make(map[pullIdentity]cachedKeychain),
+	}
+}
+
+// Start indexes the shared pod and workload informers by image and starts them.
+// Their caches sync in the background; until then images resolve to fewer or no pull secrets.
+func (k *PullSecretKeychains) Start(ctx context.Context) error {
+	for _, ns := range k.namespaces {
+		factory := k.client.informerFactory(ns)
+
+		informers := []cache.SharedIndexInformer{factory.Core().V1().Pods().Informer()}
+		for _, kind := range k.kinds {
+			informer, err := workloadInformer(factory, kind)
+			if err != nil {
+				return err
+			}
+			informers = append(informers, informer)
+		}
+		for _, informer := range informers {
+			if err := k.client.indexByImage(informer); err != nil {
+				return fmt.Errorf("failed to index informers of namespace %s: %w", ns, err)
+			}
+		}
+		k.informers = append(k.informers, informers...)
+	}
+
+	k.client.startInformers(ctx, k.namespaces, "pull_secrets")
+	return nil
+}
+
+// Keychain returns a keychain over the imagePullSecrets of every pod and workload using image,
+// directly or through its ServiceAccount, or nil if none of them references any
+func (k *PullSecretKeychains) Keychain(ctx context.Context, image string) (authn.Keychain, error) {
+	identities, err := k.identities(image)
+	if len(identities) == 0 {
+		return nil, err
+	}
+
+	keychains := make([]authn.Keychain, 0, len(identities))
+	for identity := range identities {
+		keychain, kcErr := k.keychain(ctx, identity)
+		if kcErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to read pull secrets of service account %s/%s: %w",
+				identity.namespace, identity.serviceAccount, kcErr))
+			continue
+		}
+		keychains = append(keychains, keychain)
+	}
+
+	k.logger.Debug().
+		Str("image", image).
+		Int("identities", len(identities)).
+		Msg("Resolved image pull secrets")
+
+	return authn.NewMultiKeychain(keychains...), err
+}
+
+// keychain returns the keychain of a pull identity, reading its secrets if the cached one expired
+func (k *PullSecretKeychains) keychain(ctx context.Context, identity pullIdentity) (authn.Keychain, error) {
+	k.mu.Lock()
+	cached, ok := k.keychains[identity]
+	k.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.keychain, nil
+	}
+
+	opts := k8schain.Options{
+		Namespace:          identity.namespace,
+		ServiceAccountName: identity.serviceAccount,
+	}
+	if identity.secrets != "" {
+		opts.ImagePullSecrets = strings.Split(identity.secrets, ",")
+	}
+	keychain, err := k8schain.New(ctx, k.client.clientset, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	k.keychains[identity] = cachedKeychain{keychain: keychain, expires: time.Now().Add(keychainTTL)}
+	k.mu.Unlock()
+	return keychain, nil
+}
+
+// identities collects the pull identities of the cached pods and workload templates that use image
+func (k *PullSecretKeychains) identities(image string) (map[pullIdentity]struct{}, error) {
+	identities := make(map[pullIdentity]struct{})
+	var errs []error
+
+	// Templates cover workloads that currently have no pods, e.g. scaled to zero
+	for _, informer := range k.informers {
+		objs, err := informer.GetIndexer().ByIndex(imageIndex, image)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, obj := range objs {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				addPullIdentity(identities, pod.Namespace, &pod.Spec)
+			} else if w, ok := workloadFromObject(obj); ok {
+				addPullIdentity(identities, w.namespace, w.podSpec)
+			}
+		}
+	}
+
+	return identities, errors.Join(errs...)
+}
+
+// addPullIdentity records the pull identity of a pod spec
+func addPullIdentity(identities map[pullIdentity]struct{}, namespace string, spec *corev1.PodSpec) {
+	secrets := make([]string, 0, len(spec.ImagePullSecrets))
+	for _, secret := range spec.ImagePullSecrets {
+		if secret.Name != "" {
+			secrets = append(secrets, secret.Name)
+		}
+	}
+	identities[pullIdentity{
+		namespace:      namespace,
+		serviceAccount: spec.ServiceAccountName,
+		secrets:        strings.Join(secrets, ","),
+	}] = struct{}{}
+}
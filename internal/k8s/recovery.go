@@ -0,0 +1,318 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// recoveryAnnotation records on a recovered workload which images were repinned, as JSON
+const recoveryAnnotation = "push-missed-images/recovered-images"
+
+// RecoveryMode selects what happens to workloads pinned to a digest that a restore could not reproduce
+type RecoveryMode string
+
+const (
+	// RecoveryPatch patches the workloads to the restored image
+	RecoveryPatch RecoveryMode = "patch"
+	// RecoveryEmit only records a ready-to-apply patch for each workload
+	RecoveryEmit RecoveryMode = "emit"
+)
+
+// RecoveryRecord is the audit record of one repinned container
+type RecoveryRecord struct {
+	Container   string    `json:"container"`
+	Original    string    `json:"original"`
+	Restored    string    `json:"restored"`
+	RecoveredAt time.Time `json:"recoveredAt"`
+}
+
+// WorkloadRecovery repins workload pod templates from an original image reference to a restored one.
+// Workloads using an image are looked up in the shared informer caches.
+type WorkloadRecovery struct {
+	client     *Client
+	namespaces []string
+	kinds      []WorkloadKind
+	mode       RecoveryMode
+	recorder   record.EventRecorder
+	logger     zerolog.Logger
+
+	// informers are the workload informers indexed by image
+	informers []recoveryInformer
+
+	// recovered holds the recoveries that already ran, so that resyncs neither list the workloads
+	// nor emit their patches again. It is kept per process: in emit mode nothing is written to the
+	// workloads, so each node emits a patch once after it starts.
+	mu        sync.Mutex
+	recovered map[string]struct{}
+}
+
+// recoveryInformer is the workload informer of one kind in one namespace
+type recoveryInformer struct {
+	kind      WorkloadKind
+	namespace string
+	informer  cache.SharedIndexInformer
+}
+
+// NewWorkloadRecovery creates a recovery for the workloads of the given kinds in the given namespaces
+func (c *Client) NewWorkloadRecovery(namespaces []string, kinds []WorkloadKind, mode RecoveryMode, nodeName string) *WorkloadRecovery {
+	broadcaster := record.NewBroadcaster()
+	// Events are created in the namespace of the workload they are about
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: c.clientset.CoreV1().Events(""),
+	})
+
+	return &WorkloadRecovery{
+		client:     c,
+		namespaces: namespaces,
+		kinds:      kinds,
+		mode:       mode,
+		recorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{
+			Component: eventComponent,
+			Host:      nodeName,
+		}),
+		logger:    c.logger,
+		recovered: make(map[string]struct{}),
+	}
+}
+
+// Start indexes the shared workload informers by image and starts them.
+// Recoveries fail and are retried on a later sync until the caches have synced.
+func (r *WorkloadRecovery) Start(ctx context.Context) error {
+	for _, ns := range r.namespaces {
+		factory := r.client.informerFactory(ns)
+		for _, kind := range r.kinds {
+			informer, err := workloadInformer(factory, kind)
+			if err != nil {
+				return err
+			}
+			if err := r.client.indexByImage(informer); err != nil {
+				return fmt.Errorf("failed to index %s informer of namespace %s: %w", kind, ns, err)
+			}
+			r.informers = append(r.informers, recoveryInformer{kind: kind, namespace: ns, informer: informer})
+		}
+	}
+
+	r.client.startInformers(ctx, r.namespaces, "recovery")
+	return nil
+}
+
+// Recover repins every container of the watched workloads that uses originalImage to restoredImage,
+// or records the patch that would do so, with an audit record of both references
+func (r *WorkloadRecovery) Recover(ctx context.Context, originalImage, restoredImage string) error {
+	key := originalImage + " " + restoredImage
+	r.mu.Lock()
+	_, done := r.recovered[key]
+	r.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	enabled := make(map[string]struct{}, len(r.kinds))
+	for _, kind := range r.kinds {
+		enabled[string(kind)] = struct{}{}
+	}
+
+	var errs []error
+	for _, ri := range r.informers {
+		// A workload missed by an unsynced cache would never be recovered
+		if !ri.informer.HasSynced() {
+			errs = append(errs, fmt.Errorf("%s cache of namespace %s has not synced yet", ri.kind, ri.namespace))
+			continue
+		}
+		objs, err := ri.informer.GetIndexer().ByIndex(imageIndex, originalImage)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to look up %s in namespace %s: %w", ri.kind, ri.namespace, err))
+			continue
+		}
+		for _, obj := range objs {
+			w, ok := workloadFromObject(obj)
+			if !ok {
+				continue
+			}
+			// Objects managed by another recovered controller follow their owner's template
+			if _, ok := enabled[w.ownerKind]; ok {
+				continue
+			}
+			if err := r.recoverWorkload(ctx, ri.kind, w, originalImage, restoredImage); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	r.mu.Lock()
+	r.recovered[key] = struct{}{}
+	r.mu.Unlock()
+	return nil
+}
+
+// recoverWorkload patches, or records the patch for, the containers of one workload that use originalImage
+func (r *WorkloadRecovery) recoverWorkload(ctx context.Context, kind WorkloadKind, w workload, originalImage, restoredImage string) error {
+	// A workload moved back to the original image after its recovery is left as it is
+	if recordsRecovery(w.recoveries, originalImage, restoredImage) {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	var records []RecoveryRecord
+	containers := repinContainers(w.podSpec.Containers, originalImage, restoredImage, now, &records)
+	initContainers := repinContainers(w.podSpec.InitContainers, originalImage, restoredImage, now, &records)
+	if len(records) == 0 {
+		return nil
+	}
+
+	patch, err := recoveryPatch(kind, containers, initContainers, w.recoveries, records)
+	if err != nil {
+		return fmt.Errorf("failed to build recovery patch for %s %s/%s: %w", kind, w.namespace, w.name, err)
+	}
+
+	ref := &corev1.ObjectReference{
+		Kind:       string(kind),
+		APIVersion: workloadAPIVersion(kind),
+		Namespace:  w.namespace,
+		Name:       w.name,
+		UID:        w.uid,
+	}
+	audit := r.logger.Info().
+		Str("kind", string(kind)).
+		Str("namespace", w.namespace).
+		Str("name", w.name).
+		Str("original", originalImage).
+		Str("restored", restoredImage).
+		Int("containers", len(records))
+
+	// A Job's pod template cannot change, its patch can only be applied by recreating it
+	if r.mode != RecoveryPatch || kind == KindJob {
+		command := fmt.Sprintf("kubectl patch %s %s -n %s --type strategic -p '%s'",
+			kind, w.name, w.namespace, patch)
+		audit.Str("patch", command).Msg("Workload pins an image digest that could not be restored, patch to recover")
+		r.recorder.Event(ref, corev1.EventTypeWarning, "ImageRecoveryPatch", fmt.Sprintf(
+			"%s could not be restored with its original digest; apply to use %s: %s", originalImage, restoredImage, command))
+		return nil
+	}
+
+	if err := r.patch(ctx, kind, w.namespace, w.name, patch); err != nil {
+		return fmt.Errorf("failed to patch %s %s/%s: %w", kind, w.namespace, w.name, err)
+	}
+	audit.Msg("Repinned workload to the restored image")
+	r.recorder.Event(ref, corev1.EventTypeNormal, "ImageRecovered", fmt.Sprintf(
+		"Repinned %d container(s) from %s to %s, which could not be restored with its original digest",
+		len(records), originalImage, restoredImage))
+	return nil
+}
+
+// repinContainers returns the name and new image of each container using originalImage,
+// as strategic merge patch entries, and appends their audit records
+func repinContainers(containers []corev1.Container, originalImage, restoredImage string, now time.Time, records *[]RecoveryRecord) []map[string]string {
+	var patched []map[string]string
+	for _, container := range containers {
+		if container.Image != originalImage {
+			continue
+		}
+		patched = append(patched, map[string]string{"name": container.Name, "image": restoredImage})
+		*records = append(*records, RecoveryRecord{
+			Container:   container.Name,
+			Original:    originalImage,
+			Restored:    restoredImage,
+			RecoveredAt: now,
+		})
+	}
+	return patched
+}
+
+// recordsRecovery reports whether the audit annotation of a workload already records a recovery
+// from originalImage to restoredImage
+func recordsRecovery(recoveries, originalImage, restoredImage string) bool {
+	var records []RecoveryRecord
+	if recoveries == "" || json.Unmarshal([]byte(recoveries), &records) != nil {
+		return false
+	}
+	for _, record := range records {
+		if record.Original == originalImage && record.Restored == restoredImage {
+			return true
+		}
+	}
+	return false
+}
+
+// recoveryPatch builds the strategic merge patch that repins containers and appends their records
+// to the audit annotation, given its current value
+func recoveryPatch(kind WorkloadKind, containers, initContainers []map[string]string, recoveries string, records []RecoveryRecord) ([]byte, error) {
+	var previous []RecoveryRecord
+	if recoveries != "" {
+		if err := json.Unmarshal([]byte(recoveries), &previous); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", recoveryAnnotation, err)
+		}
+	}
+	audit, err := json.Marshal(append(previous, records...))
+	if err != nil {
+		return nil, err
+	}
+
+	podSpec := map[string]interface{}{}
+	if len(containers) > 0 {
+		podSpec["containers"] = containers
+	}
+	if len(initContainers) > 0 {
+		podSpec["initContainers"] = initContainers
+	}
+	spec := map[string]interface{}{
+		"template": map[string]interface{}{"spec": podSpec},
+	}
+	if kind == KindCronJob {
+		spec = map[string]interface{}{
+			"jobTemplate": map[string]interface{}{"spec": spec},
+		}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{recoveryAnnotation: string(audit)},
+		},
+		"spec": spec,
+	})
+}
+
+// patch applies a strategic merge patch to a workload
+func (r *WorkloadRecovery) patch(ctx context.Context, kind WorkloadKind, namespace, name string, patch []byte) error {
+	opts := metav1.PatchOptions{FieldManager: eventComponent}
+	var err error
+	switch kind {
+	case KindDeployment:
+		_, err = r.client.clientset.AppsV1().Deployments(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+	case KindStatefulSet:
+		_, err = r.client.clientset.AppsV1().StatefulSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+	case KindDaemonSet:
+		_, err = r.client.clientset.AppsV1().DaemonSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+	case KindReplicaSet:
+		_, err = r.client.clientset.AppsV1().ReplicaSets(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+	case KindCronJob:
+		_, err = r.client.clientset.BatchV1().CronJobs(namespace).Patch(ctx, name, types.StrategicMergePatchType, patch, opts)
+	default:
+		return fmt.Errorf("unsupported workload kind: %s", kind)
+	}
+	return err
+}
+
+// workloadAPIVersion returns the API version of a workload kind
+func workloadAPIVersion(kind WorkloadKind) string {
+	if kind == KindJob || kind == KindCronJob {
+		return "batch/v1"
+	}
+	return "apps/v1"
+}
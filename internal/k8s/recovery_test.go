@@ -0,0 +1,247 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRecover(t *testing.T) {
+	const (
+		original = "ghcr.io/org/app:v2@sha256:a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2"
+		restored = "registry.lab/org/app:reconstructed-a1b2c3d4e5f6"
+	)
+	workloads := []runtime.Object{
+		&appsv1.Deployment{ObjectMeta: testMeta("web", ""), Spec: appsv1.DeploymentSpec{Template: testTemplate(original)}},
+		&appsv1.ReplicaSet{ObjectMeta: testMeta("web-5d8f", "Deployment"), Spec: appsv1.ReplicaSetSpec{Template: testTemplate(original)}},
+		&appsv1.StatefulSet{ObjectMeta: testMeta("db", ""), Spec: appsv1.StatefulSetSpec{Template: testTemplate("db:v1")}},
+		&batchv1.Job{ObjectMeta: testMeta("backup-2961", "CronJob"), Spec: batchv1.JobSpec{Template: testTemplate(original)}},
+		&batchv1.CronJob{ObjectMeta: testMeta("backup", ""), Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: testTemplate(original)}},
+		}},
+	}
+
+	tests := []struct {
+		name  string
+		kinds []WorkloadKind
+		want  []string
+	}{
+		{
+			name:  "owned objects follow their owners",
+			kinds: []WorkloadKind{KindDeployment, KindStatefulSet, KindReplicaSet, KindJob, KindCronJob},
+			want:  []string{"cronjobs/backup", "deployments/web"},
+		},
+		{
+			// Jobs cannot be patched and only get a patch to apply
+			name:  "owned objects when their owner kind is not recovered",
+			kinds: []WorkloadKind{KindReplicaSet, KindJob},
+			want:  []string{"replicasets/web-5d8f"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			clientset := fake.NewClientset(workloads...)
+			var (
+				mu      sync.Mutex
+				patched []string
+				lists   int
+			)
+			clientset.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				mu.Lock()
+				patched = append(patched, action.GetResource().Resource+"/"+action.(k8stesting.PatchAction).GetName())
+				mu.Unlock()
+				return false, nil, nil
+			})
+			c := &Client{clientset: clientset, logger: zerolog.Nop()}
+
+			r := c.NewWorkloadRecovery([]string{"apps"}, tt.kinds, RecoveryPatch, "node-a")
+			if err := r.Start(ctx); err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			for _, factory := range c.namespaceFactories([]string{"apps"}) {
+				factory.WaitForCacheSync(ctx.Done())
+			}
+			// Recoveries read the informer caches instead of listing the workloads again
+			clientset.PrependReactor("list", "*", func(k8stesting.Action) (bool, runtime.Object, error) {
+				mu.Lock()
+				lists++
+				mu.Unlock()
+				return false, nil, nil
+			})
+
+			for range 2 {
+				if err := r.Recover(ctx, original, restored); err != nil {
+					t.Fatalf("Recover() error = %v", err)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			slices.Sort(patched)
+			if !slices.Equal(patched, tt.want) {
+				t.Errorf("patched %v, want %v once each", patched, tt.want)
+			}
+			if lists != 0 {
+				t.Errorf("Recover() listed workloads %d times, want none", lists)
+			}
+		})
+	}
+}
+
+func TestRecoveryPatch(t *testing.T) {
+	recoveredAt := time.Date(2026, time.March, 2, 10, 0, 0, 0, time.UTC)
+	earlier := RecoveryRecord{
+		Container:   "sidecar",
+		Original:    "quay.io/org/sidecar:v1",
+		Restored:    "registry.lab/org/sidecar:v1",
+		RecoveredAt: recoveredAt.Add(-time.Hour),
+	}
+	record := RecoveryRecord{
+		Container:   "app",
+		Original:    "ghcr.io/org/app:v2",
+		Restored:    "registry.lab/org/app:v2@sha256:" + "a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2",
+		RecoveredAt: recoveredAt,
+	}
+	existing, err := json.Marshal([]RecoveryRecord{earlier})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := []map[string]string{{"name": "app", "image": record.Restored}}
+	initApp := []map[string]string{{"name": "migrate", "image": record.Restored}}
+
+	tests := []struct {
+		name           string
+		kind           WorkloadKind
+		containers     []map[string]string
+		initContainers []map[string]string
+		recoveries     string
+		wantRecords    []RecoveryRecord
+		wantSpec       string
+	}{
+		{
+			name:        "first recovery",
+			kind:        KindDeployment,
+			containers:  app,
+			wantRecords: []RecoveryRecord{record},
+			wantSpec:    `{"template":{"spec":{"containers":[{"name":"app","image":"` + record.Restored + `"}]}}}`,
+		},
+		{
+			name:        "appends to earlier recoveries",
+			kind:        KindStatefulSet,
+			containers:  app,
+			recoveries:  string(existing),
+			wantRecords: []RecoveryRecord{earlier, record},
+			wantSpec:    `{"template":{"spec":{"containers":[{"name":"app","image":"` + record.Restored + `"}]}}}`,
+		},
+		{
+			name:           "init containers only",
+			kind:           KindDaemonSet,
+			initContainers: initApp,
+			wantRecords:    []RecoveryRecord{record},
+			wantSpec:       `{"template":{"spec":{"initContainers":[{"name":"migrate","image":"` + record.Restored + `"}]}}}`,
+		},
+		{
+			name:           "cron job template",
+			kind:           KindCronJob,
+			containers:     app,
+			initContainers: initApp,
+			wantRecords:    []RecoveryRecord{record},
+			wantSpec: `{"jobTemplate":{"spec":{"template":{"spec":{` +
+				`"containers":[{"name":"app","image":"` + record.Restored + `"}],` +
+				`"initContainers":[{"name":"migrate","image":"` + record.Restored + `"}]}}}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := recoveryPatch(tt.kind, tt.containers, tt.initContainers, tt.recoveries, []RecoveryRecord{record})
+			if err != nil {
+				t.Fatalf("recoveryPatch() error = %v", err)
+			}
+
+			var got struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+				Spec json.RawMessage `json:"spec"`
+			}
+			if err := json.Unmarshal(patch, &got); err != nil {
+				t.Fatalf("patch is not valid JSON: %v", err)
+			}
+
+			var records []RecoveryRecord
+			if err := json.Unmarshal([]byte(got.Metadata.Annotations[recoveryAnnotation]), &records); err != nil {
+				t.Fatalf("invalid %s annotation: %v", recoveryAnnotation, err)
+			}
+			if !reflect.DeepEqual(records, tt.wantRecords) {
+				t.Errorf("recorded recoveries = %+v, want %+v", records, tt.wantRecords)
+			}
+
+			var spec, wantSpec interface{}
+			if err := json.Unmarshal(got.Spec, &spec); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.wantSpec), &wantSpec); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(spec, wantSpec) {
+				t.Errorf("patch spec = %s, want %s", got.Spec, tt.wantSpec)
+			}
+		})
+	}
+}
+
+func TestRecoveryPatchInvalidAnnotation(t *testing.T) {
+	containers := []map[string]string{{"name": "app", "image": "registry.lab/org/app:v2"}}
+	if _, err := recoveryPatch(KindDeployment, containers, nil, "not json", nil); err == nil {
+		t.Fatal("recoveryPatch() with an invalid annotation succeeded, want an error")
+	}
+}
+
+func TestRecordsRecovery(t *testing.T) {
+	recoveries, err := json.Marshal([]RecoveryRecord{{
+		Container: "app",
+		Original:  "ghcr.io/org/app:v2",
+		Restored:  "registry.lab/org/app:v2",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		recoveries string
+		original   string
+		restored   string
+		want       bool
+	}{
+		{name: "recorded", recoveries: string(recoveries), original: "ghcr.io/org/app:v2", restored: "registry.lab/org/app:v2", want: true},
+		{name: "other original", recoveries: string(recoveries), original: "ghcr.io/org/app:v3", restored: "registry.lab/org/app:v2", want: false},
+		{name: "other restored", recoveries: string(recoveries), original: "ghcr.io/org/app:v2", restored: "registry.lab/org/app:v3", want: false},
+		{name: "no annotation", recoveries: "", original: "ghcr.io/org/app:v2", restored: "registry.lab/org/app:v2", want: false},
+		{name: "invalid annotation", recoveries: "not json", original: "ghcr.io/org/app:v2", restored: "registry.lab/org/app:v2", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := recordsRecovery(tt.recoveries, tt.original, tt.restored); got != tt.want {
+				t.Errorf("recordsRecovery() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
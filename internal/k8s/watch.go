@@ -0,0 +1,158 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ImageHandler receives images that appeared in the cluster
+type ImageHandler func(images []Image)
+
+// WatchImages registers handlers on the shared informers of the configured namespaces and calls
+// handler with the images of every workload or pod that is created or whose images change.
+// Objects present at startup are left to the periodic full sync.
+// It returns once the informers are started; their caches sync in the background and
+// informers stop when ctx is done.
+func (c *Client) WatchImages(ctx context.Context, opts DiscoveryOptions, handler ImageHandler) error {
+	for _, ns := range opts.Namespaces {
+		factory := c.informerFactory(ns)
+
+		if opts.Mode == DiscoveryWorkloads || opts.Mode == DiscoveryAll {
+			for _, kind := range opts.Kinds {
+				informer, err := workloadInformer(factory, kind)
+				if err != nil {
+					return err
+				}
+				if _, err := informer.AddEventHandler(workloadHandler(kind, opts, handler)); err != nil {
+					return fmt.Errorf("failed to watch %s objects in namespace %s: %w", kind, ns, err)
+				}
+			}
+		}
+
+		// Only pods of this node are listed and cached when discovery is node-local
+		if opts.Mode == DiscoveryPods || opts.Mode == DiscoveryAll {
+			informer := c.nodeInformerFactory(ns, opts.NodeName).Core().V1().Pods().Informer()
+			if _, err := informer.AddEventHandler(podHandler(handler)); err != nil {
+				return fmt.Errorf("failed to watch pods in namespace %s: %w", ns, err)
+			}
+		}
+	}
+
+	c.startInformers(ctx, opts.Namespaces, "images")
+
+	c.logger.Info().
+		Strs("namespaces", opts.Namespaces).
+		Str("mode", string(opts.Mode)).
+		Msg("Watching cluster for new images")
+
+	return nil
+}
+
+// workloadInformer returns the shared informer for a workload kind
+func workloadInformer(factory informers.SharedInformerFactory, kind WorkloadKind) (cache.SharedIndexInformer, error) {
+	switch kind {
+	case KindDeployment:
+		return factory.Apps().V1().Deployments().Informer(), nil
+	case KindStatefulSet:
+		return factory.Apps().V1().StatefulSets().Informer(), nil
+	case KindDaemonSet:
+		return factory.Apps().V1().DaemonSets().Informer(), nil
+	case KindReplicaSet:
+		return factory.Apps().V1().ReplicaSets().Informer(), nil
+	case KindJob:
+		return factory.Batch().V1().Jobs().Informer(), nil
+	case KindCronJob:
+		return factory.Batch().V1().CronJobs().Informer(), nil
+	default:
+		return nil, fmt.Errorf("unsupported workload kind: %s", kind)
+	}
+}
+
+// workloadHandler reports the images of created workloads and of workloads whose pod template images changed
+func workloadHandler(kind WorkloadKind, opts DiscoveryOptions, handler ImageHandler) cache.ResourceEventHandler {
+	enabled := make(map[string]struct{}, len(opts.Kinds))
+	for _, k := range opts.Kinds {
+		enabled[string(k)] = struct{}{}
+	}
+
+	imagesOf := func(obj interface{}) map[Image]struct{} {
+		w, ok := workloadFromObject(obj)
+		if !ok {
+			return nil
+		}
+		if kind == KindDeployment && len(opts.Deployments) > 0 && !slices.Contains(opts.Deployments, w.name) {
+			return nil
+		}
+		if _, ok := enabled[w.ownerKind]; ok {
+			return nil
+		}
+		imageSet := make(map[string]struct{})
+		extractImagesFromPodSpec(w.podSpec, imageSet)
+		images := make(map[Image]struct{}, len(imageSet))
+		for image := range imageSet {
+			images[Image{Name: image}] = struct{}{}
+		}
+		return images
+	}
+
+	return cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if isInInitialList {
+				return
+			}
+			if images := newImages(nil, imagesOf(obj)); len(images) > 0 {
+				handler(images)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if images := newImages(imagesOf(oldObj), imagesOf(newObj)); len(images) > 0 {
+				handler(images)
+			}
+		},
+	}
+}
+
+// podHandler reports the images of created pods and newly resolved image digests
+func podHandler(handler ImageHandler) cache.ResourceEventHandler {
+	imagesOf := func(obj interface{}) map[Image]struct{} {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			return nil
+		}
+		imageSet := make(map[Image]struct{})
+		extractImagesFromPod(pod, imageSet)
+		return imageSet
+	}
+
+	return cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			if isInInitialList {
+				return
+			}
+			if images := newImages(nil, imagesOf(obj)); len(images) > 0 {
+				handler(images)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if images := newImages(imagesOf(oldObj), imagesOf(newObj)); len(images) > 0 {
+				handler(images)
+			}
+		},
+	}
+}
+
+// newImages returns the images in newSet that are not in oldSet
+func newImages(oldSet, newSet map[Image]struct{}) []Image {
+	var images []Image
+	for image := range newSet {
+		if _, ok := oldSet[image]; !ok {
+			images = append(images, image)
+		}
+	}
+	return images
+}
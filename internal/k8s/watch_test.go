@@ -0,0 +1,121 @@
+package k8s
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWatchImages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientset := fake.NewClientset()
+	var (
+		mu            sync.Mutex
+		podSelectors  []string
+		reported      = make(chan Image, 10)
+		podListCalled = make(chan struct{}, 1)
+	)
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		podSelectors = append(podSelectors, action.(k8stesting.ListAction).GetListRestrictions().Fields.String())
+		mu.Unlock()
+		select {
+		case podListCalled <- struct{}{}:
+		default:
+		}
+		return false, nil, nil
+	})
+	c := &Client{clientset: clientset, logger: zerolog.Nop()}
+
+	opts := DiscoveryOptions{
+		Namespaces: []string{"apps"},
+		Mode:       DiscoveryAll,
+		Kinds:      []WorkloadKind{KindDeployment},
+		NodeName:   "node-a",
+	}
+	err := c.WatchImages(ctx, opts, func(images []Image) {
+		for _, image := range images {
+			reported <- image
+		}
+	})
+	if err != nil {
+		t.Fatalf("WatchImages() error = %v", err)
+	}
+	for _, factory := range c.namespaceFactories(opts.Namespaces) {
+		factory.WaitForCacheSync(ctx.Done())
+	}
+
+	select {
+	case <-podListCalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pods were never listed")
+	}
+	mu.Lock()
+	if len(podSelectors) != 1 || podSelectors[0] != "spec.nodeName=node-a" {
+		t.Errorf("pods listed with field selectors %q, want only spec.nodeName=node-a", podSelectors)
+	}
+	mu.Unlock()
+
+	expect := func(want Image) {
+		t.Helper()
+		select {
+		case got := <-reported:
+			if got != want {
+				t.Errorf("reported %+v, want %+v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%+v was never reported", want)
+		}
+	}
+
+	deployment := &appsv1.Deployment{ObjectMeta: testMeta("web", ""), Spec: appsv1.DeploymentSpec{Template: testTemplate("web:v1")}}
+	deployments := clientset.AppsV1().Deployments("apps")
+	if _, err := deployments.Create(ctx, deployment, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect(Image{Name: "web:v1"})
+
+	// Updates report only images that were not there before
+	deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers,
+		corev1.Container{Name: "proxy", Image: "proxy:v1"})
+	if _, err := deployments.Update(ctx, deployment, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect(Image{Name: "proxy:v1"})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "apps"},
+		Spec:       corev1.PodSpec{NodeName: "node-a", Containers: []corev1.Container{{Name: "app", Image: "web:v1"}}},
+	}
+	pods := clientset.CoreV1().Pods("apps")
+	if _, err := pods.Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect(Image{Name: "web:v1"})
+
+	// The digest the kubelet resolved is reported once it appears
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "app", ImageID: "web@sha256:" + testDigestHex}}
+	if _, err := pods.UpdateStatus(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect(Image{Name: "web:v1", Digest: "sha256:" + testDigestHex})
+
+	select {
+	case image := <-reported:
+		t.Errorf("unexpected report of %+v", image)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+const testDigestHex = "0d5f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f"
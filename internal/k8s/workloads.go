@@ -0,0 +1,153 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// WorkloadKind identifies a pod-template-bearing controller kind
+type WorkloadKind string
+
+const (
+	KindDeployment  WorkloadKind = "Deployment"
+	KindStatefulSet WorkloadKind = "StatefulSet"
+	KindDaemonSet   WorkloadKind = "DaemonSet"
+	KindReplicaSet  WorkloadKind = "ReplicaSet"
+	KindJob         WorkloadKind = "Job"
+	KindCronJob     WorkloadKind = "CronJob"
+)
+
+// workload is a controller object reduced to what image discovery and recovery need
+type workload struct {
+	name      string
+	namespace string
+	uid       types.UID
+	ownerKind string
+	// recoveries is the recovery audit annotation, empty if the workload was never recovered
+	recoveries string
+	podSpec    *corev1.PodSpec
+}
+
+// listWorkloads lists all objects of the given kind in a namespace
+func (c *Client) listWorkloads(ctx context.Context, kind WorkloadKind, namespace string) ([]workload, error) {
+	var workloads []workload
+
+	switch kind {
+	case KindDeployment:
+		list, err := c.clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			workloads = append(workloads, newWorkload(&obj.ObjectMeta, &obj.Spec.Template.Spec))
+		}
+	case KindStatefulSet:
+		list, err := c.clientset.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			workloads = append(workloads, newWorkload(&obj.ObjectMeta, &obj.Spec.Template.Spec))
+		}
+	case KindDaemonSet:
+		list, err := c.clientset.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			workloads = append(workloads, newWorkload(&obj.ObjectMeta, &obj.Spec.Template.Spec))
+		}
+	case KindReplicaSet:
+		list, err := c.clientset.AppsV1().ReplicaSets(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			workloads = append(workloads, newWorkload(&obj.ObjectMeta, &obj.Spec.Template.Spec))
+		}
+	case KindJob:
+		list, err := c.clientset.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			workloads = append(workloads, newWorkload(&obj.ObjectMeta, &obj.Spec.Template.Spec))
+		}
+	case KindCronJob:
+		list, err := c.clientset.BatchV1().CronJobs(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			workloads = append(workloads, newWorkload(&obj.ObjectMeta, &obj.Spec.JobTemplate.Spec.Template.Spec))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported workload kind: %s", kind)
+	}
+
+	return workloads, nil
+}
+
+// workloadFromObject converts a typed controller object delivered by an informer into a workload
+func workloadFromObject(obj interface{}) (workload, bool) {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return newWorkload(&o.ObjectMeta, &o.Spec.Template.Spec), true
+	case *appsv1.StatefulSet:
+		return newWorkload(&o.ObjectMeta, &o.Spec.Template.Spec), true
+	case *appsv1.DaemonSet:
+		return newWorkload(&o.ObjectMeta, &o.Spec.Template.Spec), true
+	case *appsv1.ReplicaSet:
+		return newWorkload(&o.ObjectMeta, &o.Spec.Template.Spec), true
+	case *batchv1.Job:
+		return newWorkload(&o.ObjectMeta, &o.Spec.Template.Spec), true
+	case *batchv1.CronJob:
+		return newWorkload(&o.ObjectMeta, &o.Spec.JobTemplate.Spec.Template.Spec), true
+	default:
+		return workload{}, false
+	}
+}
+
+// newWorkload builds a workload from object metadata and its pod template spec
+func newWorkload(meta *metav1.ObjectMeta, podSpec *corev1.PodSpec) workload {
+	w := workload{
+		name:       meta.Name,
+		namespace:  meta.Namespace,
+		uid:        meta.UID,
+		recoveries: meta.Annotations[recoveryAnnotation],
+		podSpec:    podSpec,
+	}
+	if owner := metav1.GetControllerOf(meta); owner != nil {
+		w.ownerKind = owner.Kind
+	}
+	return w
+}
+
+// extractImagesFromPodSpec extracts all images from a pod spec
+func extractImagesFromPodSpec(spec *corev1.PodSpec, imageSet map[string]struct{}) {
+	// Extract from init containers
+	for _, container := range spec.InitContainers {
+		if container.Image != "" {
+			imageSet[container.Image] = struct{}{}
+		}
+	}
+
+	// Extract from regular containers
+	for _, container := range spec.Containers {
+		if container.Image != "" {
+			imageSet[container.Image] = struct{}{}
+		}
+	}
+}
@@ -33,6 +33,87 @@ var (
 		[]string{"source_registry", "target_registry"},
 	)
 
+	// ImagesNotPresentLocally tracks restores skipped because the image is not on this node
+	ImagesNotPresentLocally = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "images_not_present_locally_total",
+			Help: "Total number of missing images that could not be restored because they are not in the local container runtime",
+		},
+		[]string{"source_registry", "target_registry"},
+	)
+
+	// RestoreClaims tracks attempts to claim a restore across nodes
+	RestoreClaims = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "restore_claims_total",
+			Help: "Total number of attempts to claim an image restore, by result (acquired, held_elsewhere, error, unfinished)",
+		},
+		[]string{"result"},
+	)
+
+	// PullFailuresDetected tracks image pull failures that triggered an immediate restore
+	PullFailuresDetected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pull_failures_detected_total",
+			Help: "Total number of ErrImagePull/ImagePullBackOff occurrences for target registry images, by source (pod_status, event)",
+		},
+		[]string{"source"},
+	)
+
+	// ImageDigestDrift tracks target tags whose content differs from the running image
+	ImageDigestDrift = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "image_digest_drift_total",
+			Help: "Total number of target registry tags found pointing to different content than the running image, by action (reported, repaired)",
+		},
+		[]string{"target_registry", "action"},
+	)
+
+	// PlatformsUnrecovered tracks platforms of multi-arch images that could not be restored
+	PlatformsUnrecovered = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "image_platforms_unrecovered_total",
+			Help: "Total number of image index platforms missing from the runtime and the target registry during a restore",
+		},
+		[]string{"target_registry"},
+	)
+
+	// RestoreBlobBytes tracks blob bytes uploaded or skipped when restoring images from the runtime
+	RestoreBlobBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "restore_blob_bytes_total",
+			Help: "Total number of blob bytes handled when restoring images from the container runtime, by result (uploaded, skipped)",
+		},
+		[]string{"target_registry", "result"},
+	)
+
+	// ImagesReconstructed counts restores whose layers were rebuilt from runtime snapshots
+	ImagesReconstructed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "images_reconstructed_total",
+			Help: "Total number of images restored with layers rebuilt from snapshots after containerd garbage collected their blobs",
+		},
+		[]string{"target_registry"},
+	)
+
+	// WorkloadRecoveries counts attempts to repin workloads to restored content
+	WorkloadRecoveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "workload_recoveries_total",
+			Help: "Total number of attempts to point workloads pinned to an unreproducible digest at the restored image, by result (recovered, error)",
+		},
+		[]string{"result"},
+	)
+
+	// RuntimeInfo exposes the detected container runtime as labels
+	RuntimeInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "container_runtime_info",
+			Help: "Container runtime detected on the node, by runtime, version and detection source (cri, containerd, docker_api, node_status)",
+		},
+		[]string{"runtime", "version", "source"},
+	)
+
 	// SyncDuration tracks sync cycle duration
 	SyncDuration = promauto.NewHistogram(
 		prometheus.HistogramOpts{
@@ -59,6 +140,15 @@ var (
 		[]string{"registry", "status"},
 	)
 
+	// RegistryErrors tracks failed sync attempts by the registry that failed and the kind of failure
+	RegistryErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "registry_errors_total",
+			Help: "Total number of sync attempts failed by a registry, by kind of failure",
+		},
+		[]string{"registry", "reason"},
+	)
+
 	// ImageSyncDuration tracks individual image sync duration
 	ImageSyncDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// configFileKeychain resolves per-registry credentials from a Docker config.json,
+// such as a mounted kubernetes.io/dockerconfigjson secret
+type configFileKeychain struct {
+	path string
+}
+
+// NewConfigFileKeychain returns a keychain that looks up each registry host in a Docker config.json.
+// The file is read on every lookup so that rotated secrets are picked up without a restart.
+func NewConfigFileKeychain(path string) (authn.Keychain, error) {
+	kc := &configFileKeychain{path: path}
+	if _, err := kc.load(); err != nil {
+		return nil, err
+	}
+	return kc, nil
+}
+
+// Resolve returns the credentials stored for the target's repository or registry, or anonymous access
+func (k *configFileKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	cf, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	return authFromConfigFile(cf, target)
+}
+
+// load parses the config file
+func (k *configFileKeychain) load() (*configfile.ConfigFile, error) {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open registry credentials: %w", err)
+	}
+	defer f.Close()
+
+	cf, err := config.LoadFromReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registry credentials %s: %w", k.path, err)
+	}
+	return cf, nil
+}
+
+// authFromConfigFile looks up the target's repository, then its registry host, in a Docker config file
+func authFromConfigFile(cf *configfile.ConfigFile, target authn.Resource) (authn.Authenticator, error) {
+	var empty types.AuthConfig
+	for _, key := range []string{target.String(), target.RegistryStr()} {
+		// Docker Hub credentials are stored under the legacy index URL
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+
+		cfg, err := cf.GetAuthConfig(key)
+		if err != nil {
+			return nil, err
+		}
+		// GetAuthConfig fills in the server address, which would make every entry look set
+		cfg.ServerAddress = ""
+		if cfg != empty {
+			return authn.FromConfig(authn.AuthConfig{
+				Username:      cfg.Username,
+				Password:      cfg.Password,
+				Auth:          cfg.Auth,
+				IdentityToken: cfg.IdentityToken,
+				RegistryToken: cfg.RegistryToken,
+			}), nil
+		}
+	}
+	return authn.Anonymous, nil
+}
+
+// SetSourceKeychain sets the credentials used to pull images from source registries.
+// Target registry credentials are never sent to source registries.
+func (c *Client) SetSourceKeychain(keychain authn.Keychain) {
+	c.sourceKeychain = keychain
+}
+
+// SourceKeychainResolver finds the credentials the cluster itself pulls an image with
+type SourceKeychainResolver interface {
+	// Keychain returns the keychain for pulling image as named in a pod spec, nil if there is none
+	Keychain(ctx context.Context, image string) (authn.Keychain, error)
+}
+
+// SetSourceKeychainResolver makes copies of an image use the credentials its workloads pull it with,
+// ahead of the source keychain
+func (c *Client) SetSourceKeychainResolver(resolver SourceKeychainResolver) {
+	c.keychainResolver = resolver
+}
+
+// imageKeychain returns the keychain for pulling sourceImage from its source registry
+func (c *Client) imageKeychain(ctx context.Context, sourceImage string) authn.Keychain {
+	if c.keychainResolver == nil {
+		return c.sourceKeychain
+	}
+
+	keychain, err := c.keychainResolver.Keychain(ctx, sourceImage)
+	if err != nil {
+		c.logger.Warn().
+			Err(err).
+			Str("image", sourceImage).
+			Msg("Failed to resolve some image pull secrets")
+	}
+	if keychain == nil {
+		return c.sourceKeychain
+	}
+	return authn.NewMultiKeychain(keychain, c.sourceKeychain)
+}
+
+// sourceOptions returns the options for pulling from a source registry with the given keychain
+func (c *Client) sourceOptions(ctx context.Context, keychain authn.Keychain) []remote.Option {
+	return []remote.Option{
+		remote.WithAuthFromKeychain(keychain),
+		remote.WithTransport(c.transport),
+		remote.WithContext(ctx),
+	}
+}
@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
+)
+
+// blobChecker checks which blobs already exist in a target repository
+type blobChecker struct {
+	repo   name.Repository
+	client *http.Client
+	// pushed are the blobs already handled during this restore
+	pushed map[v1.Hash]struct{}
+}
+
+// newBlobChecker authenticates against the target repository once for all blob checks of a restore
+func (c *Client) newBlobChecker(ctx context.Context, repo name.Repository) (*blobChecker, error) {
+	rt, err := transport.NewWithContext(ctx, repo.Registry, c.auth, c.transport, []string{repo.Scope(transport.PushScope)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate to %s: %w", repo.RegistryStr(), err)
+	}
+	return &blobChecker{
+		repo:   repo,
+		client: &http.Client{Transport: rt},
+		pushed: make(map[v1.Hash]struct{}),
+	}, nil
+}
+
+// exists sends a HEAD request for a blob of the repository
+func (b *blobChecker) exists(ctx context.Context, digest v1.Hash) (bool, error) {
+	u := url.URL{
+		Scheme: b.repo.Scheme(),
+		Host:   b.repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/blobs/%s", b.repo.RepositoryStr(), digest),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusNotFound); err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// open sends a GET request for a blob of the repository
+func (b *blobChecker) open(ctx context.Context, digest v1.Hash) (io.ReadCloser, error) {
+	u := url.URL{
+		Scheme: b.repo.Scheme(),
+		Host:   b.repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/blobs/%s", b.repo.RepositoryStr(), digest),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// writeImage uploads only the config and layers of img that are missing from the target
+// repository and then pushes its manifest
+func (c *Client) writeImage(ctx context.Context, checker *blobChecker, ref name.Reference, img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return fmt.Errorf("failed to read image layers: %w", err)
+	}
+	config, err := partial.ConfigLayer(img)
+	if err != nil {
+		return fmt.Errorf("failed to read image config: %w", err)
+	}
+
+	for _, layer := range append(layers, config) {
+		if err := c.writeBlob(ctx, checker, layer); err != nil {
+			return err
+		}
+	}
+
+	if err := remote.Put(ref, img, c.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("failed to push manifest: %w", err)
+	}
+	return nil
+}
+
+// writeBlob uploads a blob unless the target repository already holds it
+func (c *Client) writeBlob(ctx context.Context, checker *blobChecker, layer v1.Layer) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	if _, ok := checker.pushed[digest]; ok {
+		return nil
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return err
+	}
+
+	exists, err := checker.exists(ctx, digest)
+	if err != nil {
+		return fmt.Errorf("failed to check blob %s: %w", digest, err)
+	}
+	if exists {
+		metrics.RestoreBlobBytes.WithLabelValues(c.targetRegistry, "skipped").Add(float64(size))
+		c.logger.Debug().
+			Str("repository", checker.repo.String()).
+			Str("digest", digest.String()).
+			Msg("Blob already present in target registry")
+		checker.pushed[digest] = struct{}{}
+		return nil
+	}
+
+	if err := remote.WriteLayer(checker.repo, layer, c.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("failed to push blob %s: %w", digest, err)
+	}
+	metrics.RestoreBlobBytes.WithLabelValues(c.targetRegistry, "uploaded").Add(float64(size))
+	checker.pushed[digest] = struct{}{}
+	return nil
+}
@@ -2,12 +2,16 @@ package registry
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/rs/zerolog"
@@ -16,42 +20,157 @@ import (
 
 // Client handles container registry operations
 type Client struct {
-	options              []crane.Option
-	auth                 authn.Authenticator
-	logger               zerolog.Logger
-	targetRegistry       string
+	*nodeRuntime
+
+	auth             authn.Authenticator
+	sourceKeychain   authn.Keychain
+	keychainResolver SourceKeychainResolver
+	mapper           *repositoryMapper
+	owned            ownedRegistries
+	baseTransport    *http.Transport
+	transport        http.RoundTripper
+	retryAfter       *retryAfterTransport
+	plainHTTP        map[string]struct{}
+	logger           zerolog.Logger
+	targetRegistry   string
+	coordinator      RestoreCoordinator
+	verifyMode       VerifyMode
+	recorder         EventRecorder
+	recoverer        WorkloadRecoverer
+}
+
+// nodeRuntime is the connection to the node's container runtime, shared by the clients of all
+// target registries
+type nodeRuntime struct {
 	containerdSocketPath string
 	runtimeType          RuntimeType
+	containerd           *containerdClient
+	docker               *dockerClient
+	cri                  *criClient
+	containersStorage    string
+	closeOnce            sync.Once
+	closeErr             error
+
+	// restoring holds the images this process is restoring, so that sync workers never restore one twice
+	restoringMu sync.Mutex
+	restoring   map[string]struct{}
 }
 
-// ImageRef represents a parsed container image reference
+// ImageRef represents a parsed container image reference.
+// A reference may carry a tag, a digest or both (repo:tag@sha256:...).
 type ImageRef struct {
 	Registry   string
 	Repository string
 	Tag        string
+	Digest     string
 	FullRef    string
 }
 
 // NewClient creates a new registry client
 func NewClient(registryURL, username, password, containerdSocketPath string, runtimeType RuntimeType, logger zerolog.Logger) (*Client, error) {
+	rt, err := newNodeRuntime(containerdSocketPath, runtimeType)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(registryURL, username, password, rt, logger)
+}
+
+// NewTargetClient creates a client for another target registry that shares the container runtime
+// connection, its settings and the restore guard of c
+func (c *Client) NewTargetClient(registryURL, username, password string, logger zerolog.Logger) (*Client, error) {
+	return newClient(registryURL, username, password, c.nodeRuntime, logger)
+}
+
+// newNodeRuntime connects to the container runtime of the node
+func newNodeRuntime(containerdSocketPath string, runtimeType RuntimeType) (*nodeRuntime, error) {
+	rt := &nodeRuntime{
+		containerdSocketPath: containerdSocketPath,
+		runtimeType:          runtimeType,
+		restoring:            make(map[string]struct{}),
+	}
+
+	switch runtimeType {
+	case RuntimeContainerd:
+		containerd, err := newContainerdClient(containerdSocketPath, []string{DefaultContainerdNamespace})
+		if err != nil {
+			return nil, err
+		}
+		rt.containerd = containerd
+	case RuntimeDocker, RuntimePodman:
+		// Podman serves the Docker-compatible API on its socket
+		rt.docker = newDockerClient(containerdSocketPath)
+	case RuntimeCRIO:
+		cri, err := newCRIClient(containerdSocketPath)
+		if err != nil {
+			return nil, err
+		}
+		rt.cri = cri
+		rt.containersStorage = DefaultContainersStoragePath
+	}
+	return rt, nil
+}
+
+// newClient creates a client for a target registry on a runtime connection
+func newClient(registryURL, username, password string, rt *nodeRuntime, logger zerolog.Logger) (*Client, error) {
 	auth := &authn.Basic{
 		Username: username,
 		Password: password,
 	}
 
-	options := []crane.Option{
-		crane.WithAuth(auth),
-		crane.WithContext(context.Background()),
+	retryAfter := newRetryAfterTransport(remote.DefaultTransport)
+	client := &Client{
+		targetRegistry: strings.TrimSuffix(registryURL, "/"),
+		auth:           auth,
+		sourceKeychain: authn.DefaultKeychain,
+		mapper:         newRepositoryMapper(nil),
+		transport:      retryAfter,
+		retryAfter:     retryAfter,
+		logger:         logger,
+		nodeRuntime:    rt,
+	}
+	if err := client.SetOwnedRegistries(nil); err != nil {
+		return nil, fmt.Errorf("invalid target registry: %w", err)
 	}
+	return client, nil
+}
 
-	return &Client{
-		targetRegistry:       strings.TrimSuffix(registryURL, "/"),
-		auth:                 auth,
-		logger:               logger,
-		options:              options,
-		containerdSocketPath: containerdSocketPath,
-		runtimeType:          runtimeType,
-	}, nil
+// TargetRegistry returns the registry images are mirrored to
+func (c *Client) TargetRegistry() string {
+	return c.targetRegistry
+}
+
+// Close releases the connection to the container runtime, also for the clients sharing it
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		switch {
+		case c.containerd != nil:
+			c.closeErr = c.containerd.Close()
+		case c.docker != nil:
+			c.closeErr = c.docker.Close()
+		case c.cri != nil:
+			c.closeErr = c.cri.Close()
+		}
+	})
+	return c.closeErr
+}
+
+// SetContainerdNamespaces sets the containerd namespaces searched, in order, for images to restore
+func (c *Client) SetContainerdNamespaces(namespaces []string) {
+	if c.containerd != nil && len(namespaces) > 0 {
+		c.containerd.namespaces = namespaces
+	}
+}
+
+// SetContainersStoragePath sets where the host's containers/storage is mounted, used to export CRI-O images.
+// On CRI-O nodes the store must be mounted there, otherwise every image would look garbage collected.
+func (c *Client) SetContainersStoragePath(path string) error {
+	if c.runtimeType == RuntimeCRIO {
+		if _, err := os.Stat(filepath.Join(path, "overlay-images", "images.json")); err != nil {
+			return fmt.Errorf("containers/storage is not mounted at %s, mount the host's store to restore images from CRI-O: %w", path, err)
+		}
+	}
+	c.containersStorage = path
+	return nil
 }
 
 // ParseImageRef parses an image reference into components
@@ -61,71 +180,204 @@ func ParseImageRef(image string) (*ImageRef, error) {
 		return nil, fmt.Errorf("failed to parse image reference: %w", err)
 	}
 
-	registry := ref.Context().RegistryStr()
-	repository := ref.Context().RepositoryStr()
-	tag := "latest"
+	imageRef := &ImageRef{
+		Registry:   ref.Context().RegistryStr(),
+		Repository: ref.Context().RepositoryStr(),
+	}
 
-	if t, ok := ref.(name.Tag); ok {
-		tag = t.TagStr()
+	switch r := ref.(type) {
+	case name.Tag:
+		imageRef.Tag = r.TagStr()
+	case name.Digest:
+		imageRef.Digest = r.DigestStr()
+		// name.Digest validates but drops a tag given alongside the digest, keep it. A colon
+		// before the last slash separates a registry port, not a tag.
+		base := image[:strings.LastIndex(image, "@")]
+		if i := strings.LastIndex(base, ":"); i > strings.LastIndex(base, "/") {
+			imageRef.Tag = base[i+1:]
+		}
 	}
 
-	return &ImageRef{
-		Registry:   registry,
-		Repository: repository,
-		Tag:        tag,
-		FullRef:    ref.Name(),
-	}, nil
+	imageRef.FullRef = imageRef.String()
+	return imageRef, nil
+}
+
+// Name returns the fully qualified repository name without tag or digest
+func (r *ImageRef) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// String returns the reference with its tag and/or digest
+func (r *ImageRef) String() string {
+	return r.Name() + refSuffix(r.Tag, r.Digest)
+}
+
+// TagRef returns the tag form of the reference, or an empty string if it has no tag
+func (r *ImageRef) TagRef() string {
+	if r.Tag == "" {
+		return ""
+	}
+	return r.Name() + ":" + r.Tag
+}
+
+// DigestRef returns the digest form of the reference, or an empty string if it has no digest
+func (r *ImageRef) DigestRef() string {
+	if r.Digest == "" {
+		return ""
+	}
+	return r.Name() + "@" + r.Digest
+}
+
+// PushRef returns the reference to write content to: the tag if there is one,
+// so that both the tag and the content digest resolve, otherwise the digest
+func (r *ImageRef) PushRef() string {
+	if r.Tag != "" {
+		return r.TagRef()
+	}
+	return r.DigestRef()
+}
+
+// refSuffix formats the tag and digest part of a reference
+func refSuffix(tag, digest string) string {
+	suffix := ""
+	if tag != "" {
+		suffix += ":" + tag
+	}
+	if digest != "" {
+		suffix += "@" + digest
+	}
+	return suffix
 }
 
-// BuildTargetRef constructs the target image reference
+// BuildTargetRef constructs the target image reference.
+// It fails with ErrMappingConflict if another source repository already maps onto the same target.
 func (c *Client) BuildTargetRef(sourceImage string) (string, error) {
 	ref, err := ParseImageRef(sourceImage)
 	if err != nil {
 		return "", err
 	}
 
-	// Extract repository path (remove source registry)
-	var repoPath string
+	// Images hosted on the target registry are restored where they are, other
+	// repositories are placed by the mapping rules
+	owned := c.IsTargetImage(sourceImage)
+	repoPath := c.ownedRepository(ref)
+	if !owned {
+		repoPath = c.mapper.targetRepository(ref)
+	}
 
-	// If registry is docker.io or index.docker.io, keep the full path
-	if ref.Registry == "index.docker.io" || ref.Registry == "docker.io" {
-		repoPath = ref.Repository
-	} else {
-		// For other registries, keep only the path after registry
-		repoPath = strings.TrimPrefix(ref.Repository, ref.Registry+"/")
+	targetRepo := fmt.Sprintf("%s/%s", c.targetRegistry, repoPath)
+	if _, err := name.NewRepository(targetRepo); err != nil {
+		return "", fmt.Errorf("invalid target repository %s for %s: %w", targetRepo, ref.Name(), err)
+	}
+	// Every alias of an owned registry names the same repository
+	source := ref.Name()
+	if owned {
+		source = targetRepo
+	}
+	if err := c.mapper.claim(source, targetRepo); err != nil {
+		return "", err
 	}
 
-	targetImage := fmt.Sprintf("%s/%s:%s", c.targetRegistry, repoPath, ref.Tag)
-	return targetImage, nil
+	return targetRepo + refSuffix(ref.Tag, ref.Digest), nil
 }
 
-// ImageExists checks if an image already exists in the target registry
+// ImageExists checks if an image already exists in the target registry.
+// For references with a digest the content must be present: a tag that resolves to the digest,
+// or the digest itself when the tag has moved on to other content. A missing digest counts as not existing.
 func (c *Client) ImageExists(ctx context.Context, imageRef string) (bool, error) {
 	start := time.Now()
 	defer func() {
 		metrics.ImageSyncDuration.WithLabelValues("check_exists").Observe(time.Since(start).Seconds())
 	}()
 
-	ref, err := name.ParseReference(imageRef)
+	target, err := ParseImageRef(imageRef)
 	if err != nil {
-		return false, fmt.Errorf("failed to parse reference: %w", err)
+		return false, err
 	}
 
-	_, err = remote.Head(ref, remote.WithAuth(c.auth), remote.WithContext(ctx))
+	actual, err := c.remoteDigest(ctx, target.PushRef())
 	if err != nil {
-		if strings.Contains(err.Error(), "MANIFEST_UNKNOWN") ||
-			strings.Contains(err.Error(), "NAME_UNKNOWN") ||
-			strings.Contains(err.Error(), "not found") {
-			return false, nil
+		return false, err
+	}
+	if actual == "" {
+		return false, nil
+	}
+
+	if target.Digest != "" && actual != target.Digest {
+		c.logger.Debug().
+			Str("image", imageRef).
+			Str("expected_digest", target.Digest).
+			Str("actual_digest", actual).
+			Msg("Tag in target registry points to different content")
+		actual, err = c.remoteDigest(ctx, target.DigestRef())
+		if err != nil {
+			return false, err
 		}
-		return false, fmt.Errorf("failed to check if image exists: %w", err)
+		return actual != "", nil
 	}
 
 	return true, nil
 }
 
-// CopyImage copies an image from source to target registry
-func (c *Client) CopyImage(_ context.Context, sourceImage, targetImage string) error {
+// pushTarget returns where content for targetRef is pushed to. It goes under the tag only while
+// the tag is missing, or holds the stand-in of an incomplete index: a tag that resolves to other
+// content has moved on and is never rolled back, the content is pushed by digest only instead.
+func (c *Client) pushTarget(ctx context.Context, sourceRef, targetRef *ImageRef) *ImageRef {
+	if targetRef.Tag == "" || targetRef.Digest == "" {
+		return targetRef
+	}
+
+	byDigest := &ImageRef{Registry: targetRef.Registry, Repository: targetRef.Repository, Digest: targetRef.Digest}
+	byDigest.FullRef = byDigest.String()
+
+	actual, err := c.remoteDigest(ctx, targetRef.TagRef())
+	if err != nil {
+		// Without knowing where the tag points, leave it alone
+		c.logger.Debug().
+			Err(err).
+			Str("image", targetRef.FullRef).
+			Msg("Failed to resolve target tag, pushing by digest only")
+		return byDigest
+	}
+	if actual == "" || actual == targetRef.Digest || c.isPartialIndex(ctx, sourceRef, targetRef, actual) {
+		return targetRef
+	}
+
+	c.logger.Info().
+		Str("image", targetRef.FullRef).
+		Str("tag_digest", actual).
+		Msg("Target tag has moved on to other content, pushing the running content by digest only")
+	return byDigest
+}
+
+// remoteDigest returns the manifest digest a reference resolves to in the registry,
+// or an empty string if it does not exist
+func (c *Client) remoteDigest(ctx context.Context, imageRef string) (string, error) {
+	ref, err := c.parseReference(imageRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse reference: %w", err)
+	}
+
+	desc, err := remote.Head(ref, c.remoteOptions(ctx)...)
+	if err != nil {
+		err = registryError("check if image exists", ref.Context().RegistryStr(), err)
+		if errors.Is(err, ErrRegistryNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return desc.Digest.String(), nil
+}
+
+// CopyImage copies an image from source to target registry.
+// The source is pulled with the source keychain and pushed with the target credentials.
+func (c *Client) CopyImage(ctx context.Context, sourceImage, targetImage string) error {
+	return c.copyImage(ctx, sourceImage, targetImage, c.sourceKeychain)
+}
+
+// copyImage copies an image from source to target registry, pulling it with keychain
+func (c *Client) copyImage(ctx context.Context, sourceImage, targetImage string, keychain authn.Keychain) error {
 	start := time.Now()
 	defer func() {
 		metrics.ImageSyncDuration.WithLabelValues("copy").Observe(time.Since(start).Seconds())
@@ -136,17 +388,45 @@ func (c *Client) CopyImage(_ context.Context, sourceImage, targetImage string) e
 		Str("target", targetImage).
 		Msg("Copying image")
 
-	// Use crane to copy the image
-	err := crane.Copy(sourceImage, targetImage, c.options...)
+	srcRef, err := c.parseReference(sourceImage)
 	if err != nil {
-		return fmt.Errorf("failed to copy image: %w", err)
+		return fmt.Errorf("failed to parse source reference: %w", err)
+	}
+	dstRef, err := c.parseReference(targetImage)
+	if err != nil {
+		return fmt.Errorf("failed to parse target reference: %w", err)
 	}
 
+	desc, err := remote.Get(srcRef, c.sourceOptions(ctx, keychain)...)
+	if err != nil {
+		return registryError("pull "+sourceImage, srcRef.Context().RegistryStr(), err)
+	}
+
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return fmt.Errorf("failed to copy image: %w", err)
+		}
+		if err := remote.WriteIndex(dstRef, index, c.remoteOptions(ctx)...); err != nil {
+			return registryError("copy image to "+targetImage, dstRef.Context().RegistryStr(), err)
+		}
+		return nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return fmt.Errorf("failed to copy image: %w", err)
+	}
+	if err := remote.Write(dstRef, img, c.remoteOptions(ctx)...); err != nil {
+		return registryError("copy image to "+targetImage, dstRef.Context().RegistryStr(), err)
+	}
 	return nil
 }
 
-// SyncImage syncs a single image to the target registry
-func (c *Client) SyncImage(ctx context.Context, sourceImage string) error {
+// SyncImage syncs a single image to the target registry.
+// If digest is set, the content is taken from that exact manifest instead of
+// whatever the image tag currently resolves to.
+func (c *Client) SyncImage(ctx context.Context, sourceImage, digest string) error {
 	sourceRef, err := ParseImageRef(sourceImage)
 	if err != nil {
 		c.logger.Error().
@@ -156,22 +436,31 @@ func (c *Client) SyncImage(ctx context.Context, sourceImage string) error {
 		return err
 	}
 
-	targetImage, err := c.BuildTargetRef(sourceImage)
+	// A digest resolved by the kubelet pins the tag to the content that actually runs
+	if digest != "" && sourceRef.Digest == "" {
+		sourceRef.Digest = digest
+		sourceRef.FullRef = sourceRef.String()
+	}
+
+	targetImage, err := c.BuildTargetRef(sourceRef.FullRef)
 	if err != nil {
 		c.logger.Error().
 			Err(err).
 			Str("image", sourceImage).
 			Msg("Failed to build target reference")
+		if errors.Is(err, ErrMappingConflict) {
+			metrics.ImagesSyncFailed.WithLabelValues(sourceRef.Registry, c.targetRegistry, "mapping_conflict").Inc()
+		}
 		return err
 	}
 
-	c.logger.Debug().
-		Str("source", sourceImage).
-		Str("target", targetImage).
-		Msg("Processing image")
+	targetRef, err := ParseImageRef(targetImage)
+	if err != nil {
+		return err
+	}
 
-	// Check if image already exists in target registry
-	exists, err := c.ImageExists(ctx, targetImage)
+	// Check if image already exists in target registry with the running content
+	exists, err := c.verifyTarget(ctx, sourceImage, sourceRef, targetRef)
 	if err != nil {
 		c.logger.Warn().
 			Err(err).
@@ -184,19 +473,106 @@ func (c *Client) SyncImage(ctx context.Context, sourceImage string) error {
 		metrics.ImagesSkipped.WithLabelValues(sourceRef.Registry, c.targetRegistry).Inc()
 		return nil
 	}
+	targetImage = targetRef.FullRef
+	pushRef := c.pushTarget(ctx, sourceRef, targetRef)
+
+	// Content to restore or copy: the exact digest if known, the spec reference otherwise
+	contentRef := sourceImage
+	if sourceRef.Digest != "" {
+		contentRef = sourceRef.DigestRef()
+	}
+
+	c.logger.Debug().
+		Str("source", sourceImage).
+		Str("content", contentRef).
+		Str("target", pushRef.PushRef()).
+		Msg("Processing image")
 
 	// Check if source registry is the same as target registry
 	// In this case, we need to restore the image from local containerd
-	isTargetRegistry := strings.Contains(sourceImage, c.targetRegistry)
+	if c.IsTargetImage(sourceImage) {
+		var runtimeImage string
+		runtimeImage, err = RuntimeImageName(contentRef)
+		if err != nil {
+			return err
+		}
+
+		// Only the nodes that hold the image, with its content, can restore it
+		var local *LocalImage
+		local, err = c.LocalImage(ctx, runtimeImage)
+		switch {
+		case errors.Is(err, ErrImageNotPresent):
+			c.logger.Debug().
+				Str("image", runtimeImage).
+				Str("runtime", string(c.runtimeType)).
+				Msg("Image is missing from target registry but not present locally, skipping")
+			metrics.ImagesNotPresentLocally.WithLabelValues(sourceRef.Registry, c.targetRegistry).Inc()
+			return fmt.Errorf("%w: %s", ErrImageNotPresent, runtimeImage)
+		case err != nil:
+			c.logger.Warn().
+				Err(err).
+				Str("image", runtimeImage).
+				Str("runtime", string(c.runtimeType)).
+				Msg("Failed to check local container runtime, will attempt to restore")
+		case !local.Restorable() && c.runtimeType == RuntimeContainerd:
+			c.logger.Info().
+				Str("image", runtimeImage).
+				Interface("platforms", local.Platforms).
+				Msg("Image content was garbage collected by containerd, layers will be rebuilt from snapshots")
+		case !local.Restorable():
+			c.logger.Warn().
+				Str("image", runtimeImage).
+				Str("runtime", string(c.runtimeType)).
+				Interface("platforms", local.Platforms).
+				Msg("Image content was garbage collected by the container runtime, cannot restore")
+			metrics.ImagesSyncFailed.WithLabelValues(sourceRef.Registry, c.targetRegistry, "content_missing").Inc()
+			return fmt.Errorf("%w: %s", ErrContentNotFound, runtimeImage)
+		}
+
+		// A reconstruction of an image pinned only by digest is kept under a recovery tag
+		if c.recoverer != nil && pushRef.Tag == "" {
+			recovered := recoveryRef(pushRef)
+			if c.reconstructedFrom(ctx, recovered.TagRef()) == targetRef.Digest {
+				c.logger.Debug().
+					Str("image", targetImage).
+					Str("target", recovered.TagRef()).
+					Msg("Image was already reconstructed under its recovery tag, skipping")
+				metrics.ImagesSkipped.WithLabelValues(sourceRef.Registry, c.targetRegistry).Inc()
+				// Workloads still using the original digest were not recovered yet
+				if digest, digestErr := c.remoteDigest(ctx, recovered.TagRef()); digestErr == nil && digest != "" {
+					c.recoverWorkloads(ctx, sourceImage, recovered, digest)
+				}
+				return nil
+			}
+		}
+
+		var release func()
+		release, err = c.claimRestore(ctx, targetImage)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		// Another node may have finished the restore before this one claimed it
+		if c.coordinator != nil {
+			exists, err = c.ImageExists(ctx, targetImage)
+			if err == nil && exists {
+				c.logger.Debug().
+					Str("image", targetImage).
+					Msg("Image was restored by another node, skipping")
+				metrics.ImagesSkipped.WithLabelValues(sourceRef.Registry, c.targetRegistry).Inc()
+				return nil
+			}
+		}
 
-	if isTargetRegistry {
 		c.logger.Info().
 			Str("image", sourceImage).
 			Str("runtime", string(c.runtimeType)).
 			Msg("Image is from target registry but missing - restoring from container runtime")
 
 		// Try to restore from container runtime
-		err = c.PushImageFromContainerd(ctx, sourceImage, targetImage, c.containerdSocketPath, c.runtimeType)
+		err = c.PushImageFromContainerd(ctx, runtimeImage, pushRef.PushRef(), c.containerdSocketPath, c.runtimeType)
+		err = registryError("restore "+targetImage, targetRef.Registry, err)
 		if err != nil {
 			c.logger.Error().
 				Err(err).
@@ -208,6 +584,12 @@ func (c *Client) SyncImage(ctx context.Context, sourceImage string) error {
 			return err
 		}
 
+		// An export may not reproduce the original manifest; references pinned
+		// by digest keep failing in that case unless workloads are recovered
+		if targetRef.Digest != "" {
+			c.checkRestoredDigest(ctx, sourceImage, pushRef)
+		}
+
 		c.logger.Info().
 			Str("image", sourceImage).
 			Str("target", targetImage).
@@ -217,8 +599,8 @@ func (c *Client) SyncImage(ctx context.Context, sourceImage string) error {
 		return nil
 	}
 
-	// Copy image from external registry
-	err = c.CopyImage(ctx, sourceImage, targetImage)
+	// Copy image from external registry, with the pull secrets of the workloads that use it
+	err = c.copyImage(ctx, contentRef, pushRef.PushRef(), c.imageKeychain(ctx, sourceImage))
 	if err != nil {
 		c.logger.Error().
 			Err(err).
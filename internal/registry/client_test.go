@@ -0,0 +1,310 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rs/zerolog"
+)
+
+// testDigest is a well-formed digest that no test registry holds
+var testDigest = "sha256:" + strings.Repeat("ab", 32)
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		image string
+		want  ImageRef
+	}{
+		{
+			image: "nginx",
+			want:  ImageRef{Registry: "index.docker.io", Repository: "library/nginx", Tag: "latest"},
+		},
+		{
+			image: "ghcr.io/org/app:v1",
+			want:  ImageRef{Registry: "ghcr.io", Repository: "org/app", Tag: "v1"},
+		},
+		{
+			image: "ghcr.io/org/app@" + testDigest,
+			want:  ImageRef{Registry: "ghcr.io", Repository: "org/app", Digest: testDigest},
+		},
+		{
+			image: "ghcr.io/org/app:v1@" + testDigest,
+			want:  ImageRef{Registry: "ghcr.io", Repository: "org/app", Tag: "v1", Digest: testDigest},
+		},
+		{
+			image: "registry.lab:5000/org/app@" + testDigest,
+			want:  ImageRef{Registry: "registry.lab:5000", Repository: "org/app", Digest: testDigest},
+		},
+		{
+			image: "registry.lab:5000/org/app:1.2.3@" + testDigest,
+			want:  ImageRef{Registry: "registry.lab:5000", Repository: "org/app", Tag: "1.2.3", Digest: testDigest},
+		},
+		{
+			image: "registry.lab:5000/app:v1",
+			want:  ImageRef{Registry: "registry.lab:5000", Repository: "app", Tag: "v1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := ParseImageRef(tt.image)
+			if err != nil {
+				t.Fatalf("ParseImageRef() error = %v", err)
+			}
+			tt.want.FullRef = tt.want.String()
+			if *got != tt.want {
+				t.Errorf("ParseImageRef() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+
+	for _, image := range []string{"", "ghcr.io/org/app@sha256:short", "ghcr.io/Org/App:v1"} {
+		if _, err := ParseImageRef(image); err == nil {
+			t.Errorf("ParseImageRef(%q) succeeded, want an error", image)
+		}
+	}
+}
+
+func TestImageRefForms(t *testing.T) {
+	ref := &ImageRef{Registry: "registry.lab:5000", Repository: "org/app", Tag: "v1", Digest: testDigest}
+	if got, want := ref.TagRef(), "registry.lab:5000/org/app:v1"; got != want {
+		t.Errorf("TagRef() = %q, want %q", got, want)
+	}
+	if got, want := ref.DigestRef(), "registry.lab:5000/org/app@"+testDigest; got != want {
+		t.Errorf("DigestRef() = %q, want %q", got, want)
+	}
+	if got, want := ref.PushRef(), ref.TagRef(); got != want {
+		t.Errorf("PushRef() = %q, want the tag %q", got, want)
+	}
+
+	digestOnly := &ImageRef{Registry: "registry.lab:5000", Repository: "org/app", Digest: testDigest}
+	if digestOnly.TagRef() != "" {
+		t.Errorf("TagRef() of a digest-only reference = %q, want empty", digestOnly.TagRef())
+	}
+	if got, want := digestOnly.PushRef(), digestOnly.DigestRef(); got != want {
+		t.Errorf("PushRef() of a digest-only reference = %q, want %q", got, want)
+	}
+}
+
+func TestBuildTargetRef(t *testing.T) {
+	client, err := NewClient("registry.lab:5000", "", "", "", RuntimeType(""), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "nginx:1.27", want: "registry.lab:5000/library/nginx:1.27"},
+		{image: "ghcr.io/org/app@" + testDigest, want: "registry.lab:5000/org/app@" + testDigest},
+		{image: "ghcr.io/org/app:v1@" + testDigest, want: "registry.lab:5000/org/app:v1@" + testDigest},
+		{image: "registry.lab:5000/team/api:v2@" + testDigest, want: "registry.lab:5000/team/api:v2@" + testDigest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := client.BuildTargetRef(tt.image)
+			if err != nil {
+				t.Fatalf("BuildTargetRef() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("BuildTargetRef() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// newLocalRegistry serves an in-memory registry over plain HTTP on the loopback interface and
+// returns a client that targets it
+func newLocalRegistry(t *testing.T) (*Client, string) {
+	t.Helper()
+
+	srv := httptest.NewServer(ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	client, err := NewClient(host, "", "", "", RuntimeType(""), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, host
+}
+
+// pushTestImage writes a random image to the registry under image and returns its digest
+func pushTestImage(t *testing.T, client *Client, image string) string {
+	t.Helper()
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, client.remoteOptions(context.Background())...); err != nil {
+		t.Fatalf("remote.Write() error = %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest.String()
+}
+
+func TestPushTarget(t *testing.T) {
+	client, host := newLocalRegistry(t)
+	ctx := context.Background()
+	tagged := pushTestImage(t, client, host+"/org/app:v1")
+	other := pushTestImage(t, client, host+"/org/app:v2")
+	source, err := ParseImageRef("ghcr.io/org/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		image string
+		want  string
+	}{
+		{name: "tag holds the running content", image: host + "/org/app:v1@" + tagged, want: host + "/org/app:v1@" + tagged},
+		{name: "tag has moved on", image: host + "/org/app:v1@" + other, want: host + "/org/app@" + other},
+		{name: "tag is missing", image: host + "/org/app:v3@" + other, want: host + "/org/app:v3@" + other},
+		{name: "tag only", image: host + "/org/app:v1", want: host + "/org/app:v1"},
+		{name: "digest only", image: host + "/org/app@" + testDigest, want: host + "/org/app@" + testDigest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := ParseImageRef(tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := client.pushTarget(ctx, source, target); got.String() != tt.want {
+				t.Errorf("pushTarget() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageExists(t *testing.T) {
+	client, host := newLocalRegistry(t)
+	ctx := context.Background()
+	tagged := pushTestImage(t, client, host+"/org/app:v1")
+	other := pushTestImage(t, client, host+"/org/app:v2")
+
+	tests := []struct {
+		image string
+		want  bool
+	}{
+		{image: host + "/org/app:v1", want: true},
+		{image: host + "/org/app:v3", want: false},
+		{image: host + "/org/app:v1@" + tagged, want: true},
+		// The tag moved on but the running content is still there by digest
+		{image: host + "/org/app:v1@" + other, want: true},
+		{image: host + "/org/app:v1@" + testDigest, want: false},
+		{image: host + "/org/app@" + other, want: true},
+		{image: host + "/org/app@" + testDigest, want: false},
+		{image: host + "/other/app:v1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := client.ImageExists(ctx, tt.image)
+			if err != nil {
+				t.Fatalf("ImageExists() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ImageExists() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetContainersStoragePath(t *testing.T) {
+	mounted := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mounted, "overlay-images"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mounted, "overlay-images", "images.json"), []byte("[]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "storage")
+
+	tests := []struct {
+		name    string
+		runtime RuntimeType
+		path    string
+		wantErr bool
+	}{
+		{name: "CRI-O with the store mounted", runtime: RuntimeCRIO, path: mounted},
+		{name: "CRI-O without the store", runtime: RuntimeCRIO, path: missing, wantErr: true},
+		{name: "containerd ignores the store", runtime: RuntimeContainerd, path: missing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{nodeRuntime: &nodeRuntime{runtimeType: tt.runtime}}
+			err := client.SetContainersStoragePath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetContainersStoragePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && client.containersStorage != tt.path {
+				t.Errorf("containersStorage = %q, want %q", client.containersStorage, tt.path)
+			}
+		})
+	}
+}
+
+func TestNewTargetClient(t *testing.T) {
+	ctx := context.Background()
+	primary, err := NewClient("registry.lab", "user", "password", "", RuntimeType(""), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr, err := primary.NewTargetClient("dr.registry.lab", "user", "password", zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dr.TargetRegistry() != "dr.registry.lab" {
+		t.Errorf("TargetRegistry() = %q, want dr.registry.lab", dr.TargetRegistry())
+	}
+	if dr.nodeRuntime != primary.nodeRuntime {
+		t.Error("target clients do not share the container runtime connection")
+	}
+
+	// A restore in progress through one target client is seen by the others
+	release, err := primary.claimRestore(ctx, "registry.lab/org/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dr.claimRestore(ctx, "registry.lab/org/app:v1"); !errors.Is(err, ErrRestoreClaimed) {
+		t.Errorf("claimRestore() while another client restores error = %v, want ErrRestoreClaimed", err)
+	}
+	release()
+	release, err = dr.claimRestore(ctx, "registry.lab/org/app:v1")
+	if err != nil {
+		t.Fatalf("claimRestore() after release error = %v", err)
+	}
+	release()
+
+	if err := primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dr.Close(); err != nil {
+		t.Fatalf("Close() of a client sharing a closed runtime error = %v", err)
+	}
+}
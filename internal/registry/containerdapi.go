@@ -0,0 +1,304 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	diffapi "github.com/containerd/containerd/api/services/diff/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	leasesapi "github.com/containerd/containerd/api/services/leases/v1"
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	containerdtypes "github.com/containerd/containerd/api/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// containerdNamespaceHeader selects the containerd namespace of a gRPC call
+	containerdNamespaceHeader = "containerd-namespace"
+	// containerdLeaseHeader attaches a gRPC call to a containerd lease
+	containerdLeaseHeader = "containerd-lease"
+	// containerdLeaseExpireLabel lets containerd garbage collect leases left behind by a crash
+	containerdLeaseExpireLabel = "containerd.io/gc.expire"
+	// containerdLeaseDuration bounds how long a restore may hold content in the store
+	containerdLeaseDuration = time.Hour
+)
+
+var (
+	// ErrRuntimeUnavailable is returned when the container runtime socket cannot be reached
+	ErrRuntimeUnavailable = errors.New("container runtime is unavailable")
+	// ErrContentNotFound is returned when a blob referenced by an image is missing from the content store
+	ErrContentNotFound = errors.New("content not found in container runtime")
+)
+
+// RuntimeError describes a failed container runtime operation
+type RuntimeError struct {
+	Op  string
+	Ref string
+	Err error
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Ref == "" {
+		return fmt.Sprintf("failed to %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("failed to %s %s: %v", e.Op, e.Ref, e.Err)
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// containerdClient talks to the containerd image, content, lease, snapshot and diff services over gRPC.
+// Images are looked up in each namespace in order; content and leases use the first namespace,
+// see inNamespace to work on the namespace an image was found in.
+type containerdClient struct {
+	conn       *grpc.ClientConn
+	images     imagesapi.ImagesClient
+	content    contentapi.ContentClient
+	leases     leasesapi.LeasesClient
+	snapshots  snapshotsapi.SnapshotsClient
+	diff       diffapi.DiffClient
+	namespaces []string
+}
+
+// newContainerdClient creates a client for the containerd socket; the connection is established on first use
+func newContainerdClient(socketPath string, namespaces []string) (*containerdClient, error) {
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("failed to create containerd client: no namespace configured")
+	}
+	conn, err := dialUnix(socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create containerd client: %w", err)
+	}
+
+	return &containerdClient{
+		conn:       conn,
+		images:     imagesapi.NewImagesClient(conn),
+		content:    contentapi.NewContentClient(conn),
+		leases:     leasesapi.NewLeasesClient(conn),
+		snapshots:  snapshotsapi.NewSnapshotsClient(conn),
+		diff:       diffapi.NewDiffClient(conn),
+		namespaces: namespaces,
+	}, nil
+}
+
+// Close closes the connection to containerd
+func (cc *containerdClient) Close() error {
+	return cc.conn.Close()
+}
+
+// inNamespace returns a client sharing the connection that works on a single namespace
+func (cc *containerdClient) inNamespace(namespace string) *containerdClient {
+	scoped := *cc
+	scoped.namespaces = []string{namespace}
+	return &scoped
+}
+
+// withNamespace scopes a context to the client's first containerd namespace
+func (cc *containerdClient) withNamespace(ctx context.Context) context.Context {
+	return namespaceContext(ctx, cc.namespaces[0])
+}
+
+// namespaceContext scopes a context to a containerd namespace
+func namespaceContext(ctx context.Context, namespace string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, containerdNamespaceHeader, namespace)
+}
+
+// Image returns the image record stored under name in the first namespace that has it,
+// together with that namespace
+func (cc *containerdClient) Image(ctx context.Context, name string) (*imagesapi.Image, string, error) {
+	for _, namespace := range cc.namespaces {
+		resp, err := cc.images.Get(namespaceContext(ctx, namespace), &imagesapi.GetImageRequest{Name: name})
+		if err == nil {
+			return resp.Image, namespace, nil
+		}
+		if err = translateGRPCError(err, ErrImageNotPresent); !errors.Is(err, ErrImageNotPresent) {
+			return nil, "", &RuntimeError{Op: "get image", Ref: name, Err: err}
+		}
+	}
+	return nil, "", &RuntimeError{
+		Op:  "get image",
+		Ref: name,
+		Err: fmt.Errorf("%w: searched namespaces %s", ErrImageNotPresent, strings.Join(cc.namespaces, ", ")),
+	}
+}
+
+// ListImages returns the image records of all namespaces matching any of the containerd filters
+func (cc *containerdClient) ListImages(ctx context.Context, filters ...string) ([]*imagesapi.Image, error) {
+	var images []*imagesapi.Image
+	for _, namespace := range cc.namespaces {
+		resp, err := cc.images.List(namespaceContext(ctx, namespace), &imagesapi.ListImagesRequest{Filters: filters})
+		if err != nil {
+			return nil, &RuntimeError{Op: "list images", Ref: namespace, Err: translateGRPCError(err, ErrImageNotPresent)}
+		}
+		images = append(images, resp.Images...)
+	}
+	return images, nil
+}
+
+// HasContent reports whether a blob is present in the content store
+func (cc *containerdClient) HasContent(ctx context.Context, digest string) (bool, error) {
+	_, err := cc.content.Info(cc.withNamespace(ctx), &contentapi.InfoRequest{Digest: digest})
+	if err == nil {
+		return true, nil
+	}
+	err = translateGRPCError(err, ErrContentNotFound)
+	if errors.Is(err, ErrContentNotFound) {
+		return false, nil
+	}
+	return false, &RuntimeError{Op: "stat content", Ref: digest, Err: err}
+}
+
+// ContentLabels returns the labels of a blob in the content store
+func (cc *containerdClient) ContentLabels(ctx context.Context, digest string) (map[string]string, error) {
+	resp, err := cc.content.Info(cc.withNamespace(ctx), &contentapi.InfoRequest{Digest: digest})
+	if err != nil {
+		return nil, &RuntimeError{Op: "stat content", Ref: digest, Err: translateGRPCError(err, ErrContentNotFound)}
+	}
+	return resp.Info.Labels, nil
+}
+
+// ReadContent opens a blob of the content store for streaming
+func (cc *containerdClient) ReadContent(ctx context.Context, digest string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(cc.withNamespace(ctx))
+	stream, err := cc.content.Read(ctx, &contentapi.ReadContentRequest{Digest: digest})
+	if err != nil {
+		cancel()
+		return nil, &RuntimeError{Op: "read content", Ref: digest, Err: translateGRPCError(err, ErrContentNotFound)}
+	}
+	return &contentReader{stream: stream, cancel: cancel, digest: digest}, nil
+}
+
+// ReadAllContent reads a small blob such as a manifest or config into memory
+func (cc *containerdClient) ReadAllContent(ctx context.Context, digest string) ([]byte, error) {
+	rc, err := cc.ReadContent(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// WithLease creates a lease that keeps content read through the returned context
+// from being garbage collected, and returns a function that deletes it
+func (cc *containerdClient) WithLease(ctx context.Context) (context.Context, func(), error) {
+	expire := time.Now().Add(containerdLeaseDuration).UTC().Format(time.RFC3339)
+	resp, err := cc.leases.Create(cc.withNamespace(ctx), &leasesapi.CreateRequest{
+		Labels: map[string]string{containerdLeaseExpireLabel: expire},
+	})
+	if err != nil {
+		return nil, nil, &RuntimeError{Op: "create lease", Err: translateGRPCError(err, ErrContentNotFound)}
+	}
+
+	id := resp.Lease.ID
+	release := func() {
+		// The lease must go even if ctx was cancelled
+		_, _ = cc.leases.Delete(cc.withNamespace(context.Background()), &leasesapi.DeleteRequest{ID: id})
+	}
+	return metadata.AppendToOutgoingContext(ctx, containerdLeaseHeader, id), release, nil
+}
+
+// Protect adds a blob to the lease of ctx so that it survives until the lease is released
+func (cc *containerdClient) Protect(ctx context.Context, digest string) error {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	ids := md.Get(containerdLeaseHeader)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := cc.leases.AddResource(cc.withNamespace(ctx), &leasesapi.AddResourceRequest{
+		ID:       ids[0],
+		Resource: &leasesapi.Resource{ID: digest, Type: "content"},
+	})
+	if err != nil {
+		return &RuntimeError{Op: "lease content", Ref: digest, Err: translateGRPCError(err, ErrContentNotFound)}
+	}
+	return nil
+}
+
+// View creates a read-only view of a committed snapshot, or of an empty one if parent is empty,
+// and returns its mounts and a function that removes it
+func (cc *containerdClient) View(ctx context.Context, snapshotter, key, parent string) ([]*containerdtypes.Mount, func(), error) {
+	resp, err := cc.snapshots.View(cc.withNamespace(ctx), &snapshotsapi.ViewSnapshotRequest{
+		Snapshotter: snapshotter,
+		Key:         key,
+		Parent:      parent,
+	})
+	if err != nil {
+		return nil, nil, &RuntimeError{Op: "view snapshot", Ref: parent, Err: translateGRPCError(err, ErrContentNotFound)}
+	}
+
+	remove := func() {
+		// The view must go even if ctx was cancelled
+		_, _ = cc.snapshots.Remove(cc.withNamespace(context.Background()), &snapshotsapi.RemoveSnapshotRequest{
+			Snapshotter: snapshotter,
+			Key:         key,
+		})
+	}
+	return resp.Mounts, remove, nil
+}
+
+// Diff computes the changes between two sets of mounts and writes them to the content store
+// as a layer of the given media type
+func (cc *containerdClient) Diff(ctx context.Context, lower, upper []*containerdtypes.Mount, mediaType, ref string) (*containerdtypes.Descriptor, error) {
+	resp, err := cc.diff.Diff(cc.withNamespace(ctx), &diffapi.DiffRequest{
+		Left:      lower,
+		Right:     upper,
+		MediaType: mediaType,
+		Ref:       ref,
+	})
+	if err != nil {
+		return nil, &RuntimeError{Op: "diff snapshots", Ref: ref, Err: translateGRPCError(err, ErrContentNotFound)}
+	}
+	return resp.Diff, nil
+}
+
+// contentReader adapts a streaming content read to io.ReadCloser
+type contentReader struct {
+	stream contentapi.Content_ReadClient
+	cancel context.CancelFunc
+	digest string
+	buf    []byte
+}
+
+func (r *contentReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		resp, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, &RuntimeError{Op: "read content", Ref: r.digest, Err: translateGRPCError(err, ErrContentNotFound)}
+		}
+		r.buf = resp.Data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *contentReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// translateGRPCError maps gRPC status codes to the package's typed errors
+func translateGRPCError(err error, notFound error) error {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return fmt.Errorf("%w: %s", notFound, status.Convert(err).Message())
+	case codes.Unavailable:
+		return fmt.Errorf("%w: %s", ErrRuntimeUnavailable, status.Convert(err).Message())
+	default:
+		return err
+	}
+}
@@ -0,0 +1,254 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// blobSource provides the blobs of images read from a container runtime
+type blobSource interface {
+	// readAll reads a small blob such as a manifest or config into memory
+	readAll(digest v1.Hash) ([]byte, error)
+	// open streams a blob
+	open(digest v1.Hash) (io.ReadCloser, error)
+	// has reports whether a blob is available
+	has(digest v1.Hash) bool
+}
+
+// contentStore reads images from the containerd content store for the duration of one push
+type contentStore struct {
+	ctx    context.Context
+	client *containerdClient
+}
+
+// readAll protects a blob with the push lease and reads it into memory
+func (s *contentStore) readAll(digest v1.Hash) ([]byte, error) {
+	if err := s.client.Protect(s.ctx, digest.String()); err != nil {
+		return nil, err
+	}
+	return s.client.ReadAllContent(s.ctx, digest.String())
+}
+
+// open protects a blob with the push lease and streams it
+func (s *contentStore) open(digest v1.Hash) (io.ReadCloser, error) {
+	if err := s.client.Protect(s.ctx, digest.String()); err != nil {
+		return nil, err
+	}
+	return s.client.ReadContent(s.ctx, digest.String())
+}
+
+// has reports whether a blob is present in the content store
+func (s *contentStore) has(digest v1.Hash) bool {
+	ok, err := s.client.HasContent(s.ctx, digest.String())
+	return err == nil && ok
+}
+
+// newContentIndex returns the image index stored under a descriptor
+func newContentIndex(src blobSource, desc v1.Descriptor) (*contentIndex, error) {
+	raw, err := src.readAll(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return &contentIndex{store: src, desc: desc, raw: raw}, nil
+}
+
+// newContentImage returns the image manifest stored under a descriptor
+func newContentImage(src blobSource, desc v1.Descriptor) (v1.Image, error) {
+	raw, err := src.readAll(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", desc.Digest, err)
+	}
+	return partial.CompressedToImage(&contentImage{store: src, desc: desc, raw: raw, manifest: manifest})
+}
+
+// contentIndex is an image index backed by a blob source
+type contentIndex struct {
+	store blobSource
+	desc  v1.Descriptor
+	raw   []byte
+}
+
+var _ v1.ImageIndex = (*contentIndex)(nil)
+
+func (i *contentIndex) MediaType() (types.MediaType, error) {
+	return i.desc.MediaType, nil
+}
+
+func (i *contentIndex) Digest() (v1.Hash, error) {
+	return i.desc.Digest, nil
+}
+
+func (i *contentIndex) Size() (int64, error) {
+	return int64(len(i.raw)), nil
+}
+
+func (i *contentIndex) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+func (i *contentIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return v1.ParseIndexManifest(bytes.NewReader(i.raw))
+}
+
+func (i *contentIndex) Image(digest v1.Hash) (v1.Image, error) {
+	desc, err := i.child(digest)
+	if err != nil {
+		return nil, err
+	}
+	return newContentImage(i.store, desc)
+}
+
+func (i *contentIndex) ImageIndex(digest v1.Hash) (v1.ImageIndex, error) {
+	desc, err := i.child(digest)
+	if err != nil {
+		return nil, err
+	}
+	return newContentIndex(i.store, desc)
+}
+
+// child returns the descriptor of a manifest listed in the index
+func (i *contentIndex) child(digest v1.Hash) (v1.Descriptor, error) {
+	manifest, err := i.IndexManifest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	for _, desc := range manifest.Manifests {
+		if desc.Digest == digest {
+			return desc, nil
+		}
+	}
+	return v1.Descriptor{}, fmt.Errorf("manifest %s not found in index %s", digest, i.desc.Digest)
+}
+
+// contentImage is an image manifest backed by a blob source
+type contentImage struct {
+	store    blobSource
+	desc     v1.Descriptor
+	raw      []byte
+	manifest *v1.Manifest
+}
+
+func (i *contentImage) MediaType() (types.MediaType, error) {
+	return i.desc.MediaType, nil
+}
+
+func (i *contentImage) RawManifest() ([]byte, error) {
+	return i.raw, nil
+}
+
+func (i *contentImage) RawConfigFile() ([]byte, error) {
+	return i.store.readAll(i.manifest.Config.Digest)
+}
+
+func (i *contentImage) LayerByDigest(digest v1.Hash) (partial.CompressedLayer, error) {
+	if digest == i.manifest.Config.Digest {
+		return &contentLayer{store: i.store, desc: i.manifest.Config}, nil
+	}
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == digest {
+			return &contentLayer{store: i.store, desc: desc}, nil
+		}
+	}
+	return nil, fmt.Errorf("layer %s not found in manifest %s", digest, i.desc.Digest)
+}
+
+// contentLayer streams a blob from a blob source
+type contentLayer struct {
+	store blobSource
+	desc  v1.Descriptor
+}
+
+func (l *contentLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *contentLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *contentLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
+
+func (l *contentLayer) Compressed() (io.ReadCloser, error) {
+	return l.store.open(l.desc.Digest)
+}
+
+// pushFromContentStore pushes an image straight from the containerd content store, keeping
+// the original manifest bytes and therefore the original digests. Images whose layers were
+// garbage collected are rebuilt from their snapshots instead, see pushReconstructed.
+func (c *Client) pushFromContentStore(ctx context.Context, imageName, targetImage string) error {
+	if c.containerd == nil {
+		return fmt.Errorf("containerd client is not initialized")
+	}
+
+	record, namespace, err := c.containerd.Image(ctx, imageName)
+	if err != nil {
+		return err
+	}
+	c.logger.Info().
+		Str("image", imageName).
+		Str("namespace", namespace).
+		Msg("Found image in containerd namespace")
+
+	// Content and leases are scoped to the namespace that holds the image
+	containerd := c.containerd.inNamespace(namespace)
+	ctx, release, err := containerd.WithLease(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	desc, err := recordDescriptor(record)
+	if err != nil {
+		return err
+	}
+
+	ref, err := c.parseReference(targetImage)
+	if err != nil {
+		return fmt.Errorf("failed to parse reference: %w", err)
+	}
+
+	checker, err := c.newBlobChecker(ctx, ref.Context())
+	if err != nil {
+		return err
+	}
+	src := &contentStore{ctx: ctx, client: containerd}
+
+	// containerd may have discarded the compressed layers after unpacking them
+	if platforms, err := inventoryDescriptor(src, desc, nil); err == nil && !newLocalImage(LocalImage{}, platforms).Restorable() {
+		return c.pushReconstructed(ctx, checker, containerd, desc, ref, imageName)
+	}
+	return c.pushFromBlobSource(ctx, checker, src, desc, ref)
+}
+
+// pushFromBlobSource pushes the image or image index under desc, keeping its original digest
+func (c *Client) pushFromBlobSource(ctx context.Context, checker *blobChecker, src blobSource, desc v1.Descriptor, ref name.Reference) error {
+	if !desc.MediaType.IsIndex() {
+		img, err := newContentImage(src, desc)
+		if err != nil {
+			return fmt.Errorf("failed to load image from container runtime: %w", err)
+		}
+		if err := c.writeImage(ctx, checker, ref, img); err != nil {
+			return fmt.Errorf("failed to push image to registry: %w", err)
+		}
+		return nil
+	}
+
+	index, err := newContentIndex(src, desc)
+	if err != nil {
+		return fmt.Errorf("failed to load image index from container runtime: %w", err)
+	}
+	return c.pushIndex(ctx, checker, index, ref, src.has)
+}
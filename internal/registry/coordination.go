@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
+)
+
+// ErrRestoreClaimed is returned when another node or worker is already restoring an image
+var ErrRestoreClaimed = errors.New("image restore is already claimed")
+
+// RestoreCoordinator makes sure a missing image is restored by only one node at a time
+type RestoreCoordinator interface {
+	// Claim reports whether this node may restore the image. The claim is kept alive until it is
+	// released or ctx is done.
+	Claim(ctx context.Context, image string) (bool, error)
+	// Release ends a claim so that another node can take over if needed
+	Release(ctx context.Context, image string) error
+}
+
+// SetRestoreCoordinator enables cluster-wide coordination of restores
+func (c *Client) SetRestoreCoordinator(coordinator RestoreCoordinator) {
+	c.coordinator = coordinator
+}
+
+// claimRestore claims the restore of targetImage within this process and across nodes, and
+// returns a function that releases the claim once the restore is done
+func (c *Client) claimRestore(ctx context.Context, targetImage string) (func(), error) {
+	// The resync, watch and pull failure workers share the node's lease identity,
+	// so the lease alone does not keep them from restoring the same image at once
+	c.restoringMu.Lock()
+	if _, ok := c.restoring[targetImage]; ok {
+		c.restoringMu.Unlock()
+		c.logger.Debug().
+			Str("image", targetImage).
+			Msg("Restore is in progress in another worker, skipping")
+		return nil, fmt.Errorf("%w: %s is being restored by another worker", ErrRestoreClaimed, targetImage)
+	}
+	c.restoring[targetImage] = struct{}{}
+	c.restoringMu.Unlock()
+
+	done := func() {
+		c.restoringMu.Lock()
+		delete(c.restoring, targetImage)
+		c.restoringMu.Unlock()
+	}
+
+	if c.coordinator == nil {
+		return done, nil
+	}
+
+	claimed, err := c.coordinator.Claim(ctx, targetImage)
+	if err != nil {
+		// Restoring twice is better than not restoring at all
+		c.logger.Warn().
+			Err(err).
+			Str("image", targetImage).
+			Msg("Failed to claim restore, restoring without coordination")
+		metrics.RestoreClaims.WithLabelValues("error").Inc()
+		return done, nil
+	}
+	if !claimed {
+		done()
+		c.logger.Debug().
+			Str("image", targetImage).
+			Msg("Restore is claimed by another node, skipping")
+		metrics.RestoreClaims.WithLabelValues("held_elsewhere").Inc()
+		return nil, fmt.Errorf("%w: %s", ErrRestoreClaimed, targetImage)
+	}
+	metrics.RestoreClaims.WithLabelValues("acquired").Inc()
+
+	return func() {
+		defer done()
+
+		// Use a fresh context so that a cancelled sync still frees the claim
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := c.coordinator.Release(releaseCtx, targetImage); err != nil {
+			c.logger.Warn().
+				Err(err).
+				Str("image", targetImage).
+				Msg("Failed to release restore claim")
+		}
+	}, nil
+}
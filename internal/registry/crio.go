@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// criClient talks to a CRI runtime such as CRI-O over its gRPC socket
+type criClient struct {
+	conn   *grpc.ClientConn
+	images criapi.ImageServiceClient
+}
+
+// newCRIClient creates a client for a CRI socket; the connection is established on first use
+func newCRIClient(socketPath string) (*criClient, error) {
+	conn, err := dialUnix(socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CRI client: %w", err)
+	}
+
+	return &criClient{
+		conn:   conn,
+		images: criapi.NewImageServiceClient(conn),
+	}, nil
+}
+
+// Close closes the connection to the runtime
+func (cc *criClient) Close() error {
+	return cc.conn.Close()
+}
+
+// ImageStatus returns the runtime's record of an image
+func (cc *criClient) ImageStatus(ctx context.Context, imageName string) (*criapi.Image, error) {
+	resp, err := cc.images.ImageStatus(ctx, &criapi.ImageStatusRequest{
+		Image: &criapi.ImageSpec{Image: imageName},
+	})
+	if err != nil {
+		return nil, &RuntimeError{Op: "image status", Ref: imageName, Err: translateGRPCError(err, ErrImageNotPresent)}
+	}
+	// CRI reports a missing image as an empty status rather than an error
+	if resp.Image == nil {
+		return nil, &RuntimeError{Op: "image status", Ref: imageName, Err: ErrImageNotPresent}
+	}
+	return resp.Image, nil
+}
+
+// ListImages returns the runtime's records of all images
+func (cc *criClient) ListImages(ctx context.Context) ([]*criapi.Image, error) {
+	resp, err := cc.images.ListImages(ctx, &criapi.ListImagesRequest{})
+	if err != nil {
+		return nil, &RuntimeError{Op: "list images", Err: translateGRPCError(err, ErrImageNotPresent)}
+	}
+	return resp.Images, nil
+}
@@ -0,0 +1,464 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
+)
+
+// dockerClient talks to the Docker Engine API over its unix socket
+type dockerClient struct {
+	http *http.Client
+}
+
+// newDockerClient creates a client for the Docker socket
+func newDockerClient(socketPath string) *dockerClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &dockerClient{http: &http.Client{Transport: transport}}
+}
+
+// Close releases idle connections to the Docker socket
+func (dc *dockerClient) Close() error {
+	dc.http.CloseIdleConnections()
+	return nil
+}
+
+// get performs a GET request against the Engine API and checks the response status
+func (dc *dockerClient) get(ctx context.Context, op, ref, path string, query url.Values) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := dc.http.Do(req)
+	if err != nil {
+		return nil, &RuntimeError{Op: op, Ref: ref, Err: fmt.Errorf("%w: %v", ErrRuntimeUnavailable, err)}
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&apiErr)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &RuntimeError{Op: op, Ref: ref, Err: fmt.Errorf("%w: %s", ErrImageNotPresent, apiErr.Message)}
+	}
+	return nil, &RuntimeError{Op: op, Ref: ref, Err: fmt.Errorf("status %d: %s", resp.StatusCode, apiErr.Message)}
+}
+
+// dockerImage is the Engine API's record of an image
+type dockerImage struct {
+	ID           string   `json:"Id"`
+	RepoTags     []string `json:"RepoTags"`
+	RepoDigests  []string `json:"RepoDigests"`
+	Size         int64    `json:"Size"`
+	Os           string   `json:"Os"`
+	Architecture string   `json:"Architecture"`
+	Variant      string   `json:"Variant"`
+}
+
+// InspectImage returns the runtime's record of an image
+func (dc *dockerClient) InspectImage(ctx context.Context, imageName string) (*dockerImage, error) {
+	resp, err := dc.get(ctx, "inspect image", imageName, "/images/"+imageName+"/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var inspect dockerImage
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return nil, &RuntimeError{Op: "inspect image", Ref: imageName, Err: err}
+	}
+	return &inspect, nil
+}
+
+// ListImages returns the summaries of all images; platforms are only filled in by InspectImage
+func (dc *dockerClient) ListImages(ctx context.Context) ([]dockerImage, error) {
+	resp, err := dc.get(ctx, "list images", "", "/images/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var images []dockerImage
+	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
+		return nil, &RuntimeError{Op: "list images", Err: err}
+	}
+	return images, nil
+}
+
+// ExportImage streams an image as a docker save archive
+func (dc *dockerClient) ExportImage(ctx context.Context, imageName string) (io.ReadCloser, error) {
+	resp, err := dc.get(ctx, "export image", imageName, "/images/get", url.Values{"names": {imageName}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+const (
+	// archiveDocumentLimit is the size up to which a blob of a docker save archive may be a manifest
+	// or config and is held in memory until index.json tells what it is
+	archiveDocumentLimit = 4 << 20
+	// archiveBufferLimit bounds the memory held by such blobs of one archive
+	archiveBufferLimit = 64 << 20
+)
+
+// dockerArchive holds what remains of a docker save archive after its layers were streamed to the registry.
+// Exports list their blobs before index.json and manifest.json, so which blobs are manifests and
+// configs is only known at the end. Small blobs are held in memory until then and only pushed if
+// the selected image references them; larger ones are layers and streamed to the target on the way.
+type dockerArchive struct {
+	ctx     context.Context
+	checker *blobChecker
+	// uploaded are the OCI blobs the target repository holds, streamed or found there
+	uploaded map[v1.Hash]struct{}
+	// documents are the small blobs held in memory and blobs read back from the target repository, by digest
+	documents map[v1.Hash][]byte
+	// buffered is the size of the blobs held in memory
+	buffered int64
+	// files are the non-blob entries such as index.json, manifest.json and legacy configs, by path
+	files map[string][]byte
+	// layers are the legacy layer.tar entries pushed to the target repository, by path
+	layers map[string]v1.Descriptor
+	// links are symlinked legacy layers, by path
+	links map[string]string
+}
+
+func (a *dockerArchive) readAll(digest v1.Hash) ([]byte, error) {
+	if document, ok := a.documents[digest]; ok {
+		return document, nil
+	}
+	rc, err := a.open(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	document, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s back from the registry: %w", digest, err)
+	}
+	a.documents[digest] = document
+	return document, nil
+}
+
+func (a *dockerArchive) open(digest v1.Hash) (io.ReadCloser, error) {
+	if document, ok := a.documents[digest]; ok {
+		return io.NopCloser(bytes.NewReader(document)), nil
+	}
+	if _, ok := a.uploaded[digest]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrContentNotFound, digest)
+	}
+	return a.checker.open(a.ctx, digest)
+}
+
+func (a *dockerArchive) has(digest v1.Hash) bool {
+	_, uploaded := a.uploaded[digest]
+	_, buffered := a.documents[digest]
+	return uploaded || buffered
+}
+
+// pushFromDockerExport streams an image from the Docker Engine API to the registry.
+// Layers are uploaded while the archive is read, so memory stays bounded and nothing is staged on disk.
+func (c *Client) pushFromDockerExport(ctx context.Context, imageName, targetImage string) error {
+	if c.docker == nil {
+		return fmt.Errorf("docker client is not initialized")
+	}
+
+	ref, err := c.parseReference(targetImage)
+	if err != nil {
+		return fmt.Errorf("failed to parse reference: %w", err)
+	}
+
+	checker, err := c.newBlobChecker(ctx, ref.Context())
+	if err != nil {
+		return err
+	}
+
+	body, err := c.docker.ExportImage(ctx, imageName)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	archive, err := c.streamDockerArchive(ctx, checker, body)
+	if err != nil {
+		return err
+	}
+
+	// Docker 25+ exports an OCI layout that keeps the original digests
+	if indexJSON, ok := archive.files["index.json"]; ok && (len(archive.uploaded) > 0 || len(archive.documents) > 0) {
+		index, err := v1.ParseIndexManifest(bytes.NewReader(indexJSON))
+		if err != nil {
+			return fmt.Errorf("failed to parse exported index.json: %w", err)
+		}
+		desc, err := exportedManifest(index, imageName)
+		if err != nil {
+			return err
+		}
+		return c.pushFromBlobSource(ctx, checker, archive, desc, ref)
+	}
+
+	return c.pushLegacyDockerArchive(ctx, checker, archive, imageName, ref)
+}
+
+// exportedManifest selects the descriptor of imageName from the index.json of an export.
+// Docker lists each exported name with an io.containerd.image.name annotation.
+func exportedManifest(index *v1.IndexManifest, imageName string) (v1.Descriptor, error) {
+	switch len(index.Manifests) {
+	case 0:
+		return v1.Descriptor{}, fmt.Errorf("exported archive contains no image")
+	case 1:
+		return index.Manifests[0], nil
+	}
+
+	want, err := name.ParseReference(imageName)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to parse reference: %w", err)
+	}
+	for _, desc := range index.Manifests {
+		if digest, ok := want.(name.Digest); ok && desc.Digest.String() == digest.DigestStr() {
+			return desc, nil
+		}
+		if exported, err := name.ParseReference(desc.Annotations["io.containerd.image.name"]); err == nil && exported.Name() == want.Name() {
+			return desc, nil
+		}
+	}
+	return v1.Descriptor{}, fmt.Errorf("exported archive contains %d images, none of them %s", len(index.Manifests), imageName)
+}
+
+// streamDockerArchive reads a docker save archive, uploading layers missing from the target repository on the way
+func (c *Client) streamDockerArchive(ctx context.Context, checker *blobChecker, r io.Reader) (*dockerArchive, error) {
+	archive := &dockerArchive{
+		ctx:       ctx,
+		checker:   checker,
+		uploaded:  make(map[v1.Hash]struct{}),
+		documents: make(map[v1.Hash][]byte),
+		files:     make(map[string][]byte),
+		layers:    make(map[string]v1.Descriptor),
+		links:     make(map[string]string),
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return archive, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read exported archive: %w", err)
+		}
+
+		entry := path.Clean(hdr.Name)
+		switch {
+		case hdr.Typeflag == tar.TypeSymlink && path.Base(entry) == "layer.tar":
+			archive.links[entry] = path.Join(path.Dir(entry), hdr.Linkname)
+		case hdr.Typeflag != tar.TypeReg:
+			continue
+		case strings.HasPrefix(entry, "blobs/"):
+			// blobs/<algorithm>/<encoded>
+			parts := strings.Split(entry, "/")
+			if len(parts) != 3 {
+				continue
+			}
+			digest, err := v1.NewHash(parts[1] + ":" + parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("unexpected blob in exported archive: %s", entry)
+			}
+			// Possibly a manifest or config, pushed later only if the image references it
+			if hdr.Size <= archiveDocumentLimit && archive.buffered+hdr.Size <= archiveBufferLimit {
+				document, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read exported archive: %w", err)
+				}
+				archive.documents[digest] = document
+				archive.buffered += hdr.Size
+				continue
+			}
+			if err := c.uploadArchiveBlob(ctx, checker, digest, hdr.Size, tr); err != nil {
+				return nil, err
+			}
+			archive.uploaded[digest] = struct{}{}
+		case path.Base(entry) == "layer.tar":
+			desc, err := c.uploadLegacyLayer(ctx, checker, tr)
+			if err != nil {
+				return nil, err
+			}
+			archive.layers[entry] = desc
+		default:
+			// Everything besides blobs and layers is metadata: index.json, manifest.json, configs
+			file, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read exported archive: %w", err)
+			}
+			archive.files[entry] = file
+		}
+	}
+}
+
+// archiveBlob is a blob of known digest that is uploaded as is
+type archiveBlob struct {
+	digest    v1.Hash
+	size      int64
+	mediaType types.MediaType
+	r         io.Reader
+}
+
+func (b *archiveBlob) Digest() (v1.Hash, error)            { return b.digest, nil }
+func (b *archiveBlob) Size() (int64, error)                { return b.size, nil }
+func (b *archiveBlob) MediaType() (types.MediaType, error) { return b.mediaType, nil }
+func (b *archiveBlob) Compressed() (io.ReadCloser, error)  { return io.NopCloser(b.r), nil }
+
+// uploadArchiveBlob uploads an OCI blob as is, so that it keeps its digest
+func (c *Client) uploadArchiveBlob(ctx context.Context, checker *blobChecker, digest v1.Hash, size int64, r io.Reader) error {
+	layer, err := partial.CompressedToLayer(&archiveBlob{digest: digest, size: size, mediaType: types.OCILayer, r: r})
+	if err != nil {
+		return err
+	}
+	return c.writeBlob(ctx, checker, layer)
+}
+
+// uploadLegacyLayer compresses and uploads an uncompressed legacy layer while it is read.
+// Its digest is only known once compressed, so it cannot be checked against the target first.
+func (c *Client) uploadLegacyLayer(ctx context.Context, checker *blobChecker, r io.Reader) (v1.Descriptor, error) {
+	layer := stream.NewLayer(io.NopCloser(r))
+	if err := remote.WriteLayer(checker.repo, layer, c.remoteOptions(ctx)...); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to push layer: %w", err)
+	}
+
+	digest, err := layer.Digest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	metrics.RestoreBlobBytes.WithLabelValues(c.targetRegistry, "uploaded").Add(float64(size))
+	checker.pushed[digest] = struct{}{}
+	return v1.Descriptor{MediaType: types.DockerLayer, Digest: digest, Size: size}, nil
+}
+
+// legacyManifestEntry is an image listed in the manifest.json of a docker save archive
+type legacyManifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// exportedLegacyManifest selects the manifest.json entry of imageName by its repository tags
+func exportedLegacyManifest(entries []legacyManifestEntry, imageName string) (legacyManifestEntry, error) {
+	if len(entries) == 1 {
+		return entries[0], nil
+	}
+	want, err := name.ParseReference(imageName)
+	if err != nil {
+		return legacyManifestEntry{}, fmt.Errorf("failed to parse reference: %w", err)
+	}
+	for _, entry := range entries {
+		for _, tag := range entry.RepoTags {
+			if exported, err := name.ParseReference(tag); err == nil && exported.Name() == want.Name() {
+				return entry, nil
+			}
+		}
+	}
+	return legacyManifestEntry{}, fmt.Errorf("exported archive contains %d images, none of them %s", len(entries), imageName)
+}
+
+// rawManifest is a manifest pushed with its exact bytes
+type rawManifest struct {
+	raw       []byte
+	mediaType types.MediaType
+}
+
+func (m *rawManifest) RawManifest() ([]byte, error)        { return m.raw, nil }
+func (m *rawManifest) MediaType() (types.MediaType, error) { return m.mediaType, nil }
+
+// pushLegacyDockerArchive pushes the config and manifest of a pre-OCI docker save archive whose layers were already streamed
+func (c *Client) pushLegacyDockerArchive(ctx context.Context, checker *blobChecker, archive *dockerArchive, imageName string, ref name.Reference) error {
+	var entries []legacyManifestEntry
+	if err := json.Unmarshal(archive.files["manifest.json"], &entries); err != nil || len(entries) == 0 {
+		return fmt.Errorf("exported archive has no usable manifest.json")
+	}
+	entry, err := exportedLegacyManifest(entries, imageName)
+	if err != nil {
+		return err
+	}
+
+	config, ok := archive.files[path.Clean(entry.Config)]
+	if !ok {
+		return fmt.Errorf("exported archive is missing config %s", entry.Config)
+	}
+	configDigest, _, err := v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		return err
+	}
+	configLayer, err := partial.CompressedToLayer(&archiveBlob{
+		digest:    configDigest,
+		size:      int64(len(config)),
+		mediaType: types.DockerConfigJSON,
+		r:         bytes.NewReader(config),
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.writeBlob(ctx, checker, configLayer); err != nil {
+		return fmt.Errorf("failed to push image config: %w", err)
+	}
+
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+		Config: v1.Descriptor{
+			MediaType: types.DockerConfigJSON,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		},
+	}
+	for _, layerPath := range entry.Layers {
+		layerPath = path.Clean(layerPath)
+		if target, ok := archive.links[layerPath]; ok {
+			layerPath = target
+		}
+		desc, ok := archive.layers[layerPath]
+		if !ok {
+			return fmt.Errorf("exported archive is missing layer %s", layerPath)
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := remote.Put(ref, &rawManifest{raw: raw, mediaType: types.DockerManifestSchema2}, c.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("failed to push image to registry: %w", err)
+	}
+	return nil
+}
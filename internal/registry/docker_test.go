@@ -0,0 +1,218 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ociExport builds a docker save archive in the OCI layout of Docker 25+ holding imgs under
+// the given names, with blobs listed before index.json like Docker writes them
+func ociExport(t *testing.T, imgs map[string]v1.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(path string, data []byte) {
+		if err := tw.WriteHeader(&tar.Header{Name: path, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeBlob := func(digest v1.Hash, data []byte) {
+		write("blobs/"+digest.Algorithm+"/"+digest.Hex, data)
+	}
+
+	index := v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	for imageName, img := range imgs {
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, layer := range layers {
+			digest, err := layer.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rc, err := layer.Compressed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeBlob(digest, data)
+		}
+		config, err := img.RawConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		configName, err := img.ConfigName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeBlob(configName, config)
+		manifest, err := img.RawManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeBlob(digest, manifest)
+		mediaType, err := img.MediaType()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.Manifests = append(index.Manifests, v1.Descriptor{
+			MediaType:   mediaType,
+			Digest:      digest,
+			Size:        int64(len(manifest)),
+			Annotations: map[string]string{"io.containerd.image.name": imageName},
+		})
+	}
+
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("index.json", indexJSON)
+	write("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// serveDockerExport serves archive as the export of every image on a Docker Engine API stand-in
+func serveDockerExport(t *testing.T, archive []byte) string {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/get" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(archive)
+	})}
+	go func() { _ = srv.Serve(listener) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return socket
+}
+
+func TestPushFromDockerExport(t *testing.T) {
+	ctx := context.Background()
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := ociExport(t, map[string]v1.Image{
+		"docker.io/library/app:v1":   img,
+		"docker.io/library/other:v1": other,
+	})
+
+	client, host := newLocalRegistry(t)
+	client.docker = newDockerClient(serveDockerExport(t, archive))
+
+	if err := client.pushFromDockerExport(ctx, "app:v1", host+"/library/app:v1"); err != nil {
+		t.Fatalf("pushFromDockerExport() error = %v", err)
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.remoteDigest(ctx, host+"/library/app:v1"); err != nil || got != digest.String() {
+		t.Fatalf("target resolves to %q, %v, want the original digest %s", got, err, digest)
+	}
+
+	repo, err := name.NewRepository(host + "/library/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker, err := client.newBlobChecker(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDigest, err := other.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConfig, err := other.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Manifests are pushed as manifests, and blobs of other images in the archive not at all
+	for _, digest := range []v1.Hash{digest, otherDigest, otherConfig} {
+		if exists, err := checker.exists(ctx, digest); err != nil || exists {
+			t.Errorf("blob %s exists = %v, %v, want false", digest, exists, err)
+		}
+	}
+
+	if err := client.pushFromDockerExport(ctx, "missing:v1", host+"/library/missing:v1"); err == nil {
+		t.Error("pushFromDockerExport() of an image missing from a multi-image archive succeeded, want an error")
+	}
+}
+
+func TestExportedManifest(t *testing.T) {
+	app := v1.Descriptor{Digest: v1.Hash{Algorithm: "sha256", Hex: "aa"}, Annotations: map[string]string{"io.containerd.image.name": "docker.io/library/app:v1"}}
+	other := v1.Descriptor{Digest: v1.Hash{Algorithm: "sha256", Hex: "bb"}, Annotations: map[string]string{"io.containerd.image.name": "ghcr.io/org/other:v2"}}
+	index := &v1.IndexManifest{Manifests: []v1.Descriptor{app, other}}
+
+	tests := []struct {
+		image   string
+		want    v1.Hash
+		wantErr bool
+	}{
+		{image: "app:v1", want: app.Digest},
+		{image: "index.docker.io/library/app:v1", want: app.Digest},
+		{image: "ghcr.io/org/other:v2", want: other.Digest},
+		{image: "ghcr.io/org/other@sha256:" + string(bytes.Repeat([]byte("0"), 64)), wantErr: true},
+		{image: "app:v2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := exportedManifest(index, tt.image)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("exportedManifest() = %s, want an error", got.Digest)
+				}
+				return
+			}
+			if err != nil || got.Digest != tt.want {
+				t.Errorf("exportedManifest() = %s, %v, want %s", got.Digest, err, tt.want)
+			}
+		})
+	}
+
+	single := &v1.IndexManifest{Manifests: []v1.Descriptor{other}}
+	if got, err := exportedManifest(single, "app:v1"); err != nil || got.Digest != other.Digest {
+		t.Errorf("exportedManifest() of a single image = %s, %v, want %s", got.Digest, err, other.Digest)
+	}
+}
@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// Kinds of registry failures, matched with errors.Is on a RegistryError
+var (
+	// ErrRegistryNotFound is returned when the repository, manifest or blob does not exist
+	ErrRegistryNotFound = errors.New("not found in registry")
+	// ErrRegistryUnauthorized is returned when the registry rejects the credentials or denies access
+	ErrRegistryUnauthorized = errors.New("registry denied access")
+	// ErrRegistryRateLimited is returned when the registry throttles requests
+	ErrRegistryRateLimited = errors.New("registry rate limit exceeded")
+	// ErrRegistryUnavailable is returned when the registry cannot be reached or fails with a server error
+	ErrRegistryUnavailable = errors.New("registry is unavailable")
+	// ErrRegistryTLS is returned when the TLS connection to the registry cannot be established
+	ErrRegistryTLS = errors.New("registry TLS handshake failed")
+)
+
+// RegistryError describes a failed registry operation and the kind of failure
+type RegistryError struct {
+	Op       string
+	Registry string
+	// Kind is one of the ErrRegistry* errors
+	Kind error
+	Err  error
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("failed to %s on %s: %v: %v", e.Op, e.Registry, e.Kind, e.Err)
+}
+
+func (e *RegistryError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// Reason returns the kind of failure as a metric label
+func (e *RegistryError) Reason() string {
+	switch e.Kind {
+	case ErrRegistryNotFound:
+		return "not_found"
+	case ErrRegistryUnauthorized:
+		return "unauthorized"
+	case ErrRegistryRateLimited:
+		return "rate_limited"
+	case ErrRegistryUnavailable:
+		return "unavailable"
+	case ErrRegistryTLS:
+		return "tls"
+	default:
+		return "unknown"
+	}
+}
+
+// RegistryHost returns the host of the registry an image is pulled from, as RegistryError reports it
+func RegistryHost(image string) string {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return ""
+	}
+	return ref.Context().RegistryStr()
+}
+
+// SameRegistry reports whether two registry hosts name the same registry, e.g. docker.io and index.docker.io
+func SameRegistry(a, b string) bool {
+	normalizedA, errA := NormalizeRegistryHost(a)
+	normalizedB, errB := NormalizeRegistryHost(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	return normalizedA == normalizedB
+}
+
+// RetryAfter returns how much longer a registry asked, with a Retry-After header on a throttled
+// or unavailable response, not to be sent requests, or zero
+func (c *Client) RetryAfter(registry string) time.Duration {
+	return c.retryAfter.remaining(registry, time.Now())
+}
+
+// retryAfterTransport remembers the Retry-After of throttled and unavailable responses per host
+type retryAfterTransport struct {
+	next http.RoundTripper
+
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// newRetryAfterTransport wraps next to record the Retry-After of its responses
+func newRetryAfterTransport(next http.RoundTripper) *retryAfterTransport {
+	return &retryAfterTransport{next: next, until: make(map[string]time.Time)}
+}
+
+// RoundTrip sends the request and records the Retry-After of a throttled or unavailable response
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return resp, err
+	}
+
+	now := time.Now()
+	if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+		t.mu.Lock()
+		t.until[strings.ToLower(req.URL.Host)] = now.Add(wait)
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// remaining returns how long requests to host should still wait at now
+func (t *retryAfterTransport) remaining(host string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	host = strings.ToLower(host)
+	until, ok := t.until[host]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(t.until, host)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as an HTTP date, into a wait from now
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if !date.After(now) {
+			return 0, false
+		}
+		return date.Sub(now), true
+	}
+	return 0, false
+}
+
+// registryError classifies err by the registry response or connection failure that caused it.
+// Errors without such a cause, and errors that are already classified, are returned unchanged.
+func registryError(op, registry string, err error) error {
+	var registryErr *RegistryError
+	if err == nil || errors.As(err, &registryErr) {
+		return err
+	}
+	kind := classifyRegistryError(err)
+	if kind == nil {
+		return err
+	}
+
+	// A copy streams from the source while writing to the target, the response tells which one failed
+	var transportErr *transport.Error
+	if errors.As(err, &transportErr) && transportErr.Request != nil {
+		registry = transportErr.Request.URL.Host
+	}
+	return &RegistryError{Op: op, Registry: registry, Kind: kind, Err: err}
+}
+
+// classifyRegistryError maps the error codes and status of a registry response, or the
+// failure to connect, to a kind of registry failure
+func classifyRegistryError(err error) error {
+	// The caller gave up, the registry did not fail
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	// Failures of the container runtime socket are not registry failures
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		return nil
+	}
+
+	var (
+		certErr      *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		recordErr    tls.RecordHeaderError
+	)
+	// Checked first: a failed HTTPS attempt may be reported together with a plain HTTP fallback
+	if errors.As(err, &certErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) || errors.As(err, &recordErr) {
+		return ErrRegistryTLS
+	}
+	// net/http replaces the record header error of an HTTPS request to a plain HTTP server with a message
+	if strings.Contains(err.Error(), "server gave HTTP response to HTTPS client") {
+		return ErrRegistryTLS
+	}
+
+	var transportErr *transport.Error
+	if errors.As(err, &transportErr) {
+		for _, diagnostic := range transportErr.Errors {
+			switch diagnostic.Code {
+			case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode, transport.BlobUnknownErrorCode:
+				return ErrRegistryNotFound
+			case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+				return ErrRegistryUnauthorized
+			case transport.TooManyRequestsErrorCode:
+				return ErrRegistryRateLimited
+			case transport.UnavailableErrorCode:
+				return ErrRegistryUnavailable
+			}
+		}
+		// HEAD responses carry no error codes
+		switch code := transportErr.StatusCode; {
+		case code == http.StatusNotFound:
+			return ErrRegistryNotFound
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return ErrRegistryUnauthorized
+		case code == http.StatusTooManyRequests:
+			return ErrRegistryRateLimited
+		case code >= http.StatusInternalServerError:
+			return ErrRegistryUnavailable
+		}
+		return nil
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrRegistryUnavailable
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package registry
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestClassifyRegistryError(t *testing.T) {
+	diagnostic := func(code transport.ErrorCode, status int) error {
+		return &transport.Error{Errors: []transport.Diagnostic{{Code: code}}, StatusCode: status}
+	}
+	status := func(code int) error {
+		return &transport.Error{StatusCode: code}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "manifest unknown", err: diagnostic(transport.ManifestUnknownErrorCode, http.StatusNotFound), want: ErrRegistryNotFound},
+		{name: "name unknown", err: diagnostic(transport.NameUnknownErrorCode, http.StatusNotFound), want: ErrRegistryNotFound},
+		{name: "blob unknown", err: diagnostic(transport.BlobUnknownErrorCode, http.StatusNotFound), want: ErrRegistryNotFound},
+		{name: "unauthorized", err: diagnostic(transport.UnauthorizedErrorCode, http.StatusUnauthorized), want: ErrRegistryUnauthorized},
+		{name: "denied", err: diagnostic(transport.DeniedErrorCode, http.StatusForbidden), want: ErrRegistryUnauthorized},
+		{name: "too many requests", err: diagnostic(transport.TooManyRequestsErrorCode, http.StatusTooManyRequests), want: ErrRegistryRateLimited},
+		{name: "unavailable", err: diagnostic(transport.UnavailableErrorCode, http.StatusServiceUnavailable), want: ErrRegistryUnavailable},
+		{name: "code wins over status", err: diagnostic(transport.DeniedErrorCode, http.StatusNotFound), want: ErrRegistryUnauthorized},
+		{name: "HEAD not found", err: status(http.StatusNotFound), want: ErrRegistryNotFound},
+		{name: "HEAD unauthorized", err: status(http.StatusUnauthorized), want: ErrRegistryUnauthorized},
+		{name: "HEAD forbidden", err: status(http.StatusForbidden), want: ErrRegistryUnauthorized},
+		{name: "HEAD rate limited", err: status(http.StatusTooManyRequests), want: ErrRegistryRateLimited},
+		{name: "server error", err: status(http.StatusBadGateway), want: ErrRegistryUnavailable},
+		{name: "other status", err: status(http.StatusBadRequest), want: nil},
+		{name: "wrapped response", err: fmt.Errorf("failed to push: %w", status(http.StatusNotFound)), want: ErrRegistryNotFound},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: ErrRegistryUnavailable},
+		{name: "deadline exceeded", err: fmt.Errorf("request: %w", context.DeadlineExceeded), want: ErrRegistryUnavailable},
+		{name: "unknown authority", err: &url.Error{Op: "Get", URL: "https://registry.lab/v2/", Err: x509.UnknownAuthorityError{}}, want: ErrRegistryTLS},
+		{name: "HTTPS to plain HTTP", err: errors.New(`Get "https://registry.lab/v2/": http: server gave HTTP response to HTTPS client`), want: ErrRegistryTLS},
+		{name: "canceled", err: fmt.Errorf("request: %w", context.Canceled), want: nil},
+		{name: "runtime socket", err: &RuntimeError{Op: "export image", Ref: "nginx", Err: &net.OpError{Op: "dial", Err: errors.New("no such file")}}, want: nil},
+		{name: "unrelated", err: errors.New("failed to parse reference"), want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyRegistryError(tt.err); got != tt.want {
+				t.Errorf("classifyRegistryError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryError(t *testing.T) {
+	if err := registryError("push image", "registry.lab", nil); err != nil {
+		t.Fatalf("registryError(nil) = %v, want nil", err)
+	}
+
+	unclassified := errors.New("failed to parse reference")
+	if err := registryError("push image", "registry.lab", unclassified); err != unclassified {
+		t.Fatalf("registryError() of an unclassified error = %v, want it unchanged", err)
+	}
+
+	// The failing response names the registry, e.g. the source of a copy
+	req := httptest.NewRequest(http.MethodGet, "https://quay.io/v2/org/app/manifests/v1", nil)
+	err := registryError("push image", "registry.lab", &transport.Error{StatusCode: http.StatusUnauthorized, Request: req})
+	var registryErr *RegistryError
+	if !errors.As(err, &registryErr) {
+		t.Fatalf("registryError() = %v, want a RegistryError", err)
+	}
+	if registryErr.Registry != "quay.io" || registryErr.Op != "push image" {
+		t.Errorf("RegistryError = %+v, want op push image on quay.io", registryErr)
+	}
+	if !errors.Is(err, ErrRegistryUnauthorized) || registryErr.Reason() != "unauthorized" {
+		t.Errorf("RegistryError kind = %v, reason %q, want unauthorized", registryErr.Kind, registryErr.Reason())
+	}
+
+	// Errors that are already classified are not wrapped again
+	if again := registryError("sync image", "registry.lab", fmt.Errorf("sync: %w", err)); !errors.As(again, &registryErr) || registryErr.Op != "push image" {
+		t.Errorf("registryError() reclassified %v", again)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, time.March, 2, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "seconds", value: "120", want: 2 * time.Minute, wantOK: true},
+		{name: "zero seconds", value: "0", want: 0, wantOK: true},
+		{name: "surrounding spaces", value: " 30 ", want: 30 * time.Second, wantOK: true},
+		{name: "HTTP date", value: now.Add(90 * time.Second).Format(http.TimeFormat), want: 90 * time.Second, wantOK: true},
+		{name: "past HTTP date", value: now.Add(-time.Minute).Format(http.TimeFormat), wantOK: false},
+		{name: "negative seconds", value: "-5", wantOK: false},
+		{name: "empty", value: "", wantOK: false},
+		{name: "invalid", value: "soon", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/throttled":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/bad-request":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+
+	rt := newRetryAfterTransport(http.DefaultTransport)
+	client := &http.Client{Transport: rt}
+	get := func(path string) {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Only throttled and unavailable responses are honoured
+	get("/bad-request")
+	if wait := rt.remaining(host, time.Now()); wait != 0 {
+		t.Fatalf("remaining() after a bad request = %v, want 0", wait)
+	}
+
+	get("/throttled")
+	now := time.Now()
+	if wait := rt.remaining(host, now); wait <= 55*time.Second || wait > time.Minute {
+		t.Fatalf("remaining() after a throttled response = %v, want about a minute", wait)
+	}
+	if wait := rt.remaining("other.example.com", now); wait != 0 {
+		t.Fatalf("remaining() of another host = %v, want 0", wait)
+	}
+	if wait := rt.remaining(host, now.Add(2*time.Minute)); wait != 0 {
+		t.Fatalf("remaining() after the wait = %v, want 0", wait)
+	}
+	if wait := rt.remaining(host, now); wait != 0 {
+		t.Fatalf("remaining() after it expired = %v, want 0", wait)
+	}
+}
+
+func TestSameRegistry(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "index.docker.io", b: "docker.io", want: true},
+		{a: "registry.lab", b: "Registry.lab", want: true},
+		{a: "https://registry.lab/", b: "registry.lab", want: true},
+		{a: "registry.lab:5000", b: "registry.lab", want: false},
+		{a: "ghcr.io", b: "index.docker.io", want: false},
+		{a: "not a host", b: "Not A Host", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			if got := SameRegistry(tt.a, tt.b); got != tt.want {
+				t.Errorf("SameRegistry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
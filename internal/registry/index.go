@@ -0,0 +1,176 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
+)
+
+// ErrIncompleteIndex is returned when a multi-platform image cannot be restored
+// under its original digest because some platforms are not available
+var ErrIncompleteIndex = errors.New("image index is incomplete")
+
+// remoteOptions returns the options for talking to the target registry
+func (c *Client) remoteOptions(ctx context.Context) []remote.Option {
+	return []remote.Option{
+		remote.WithAuth(c.auth),
+		remote.WithTransport(c.transport),
+		remote.WithContext(ctx),
+	}
+}
+
+// pushIndex pushes the locally available platforms of an index and the index itself if it is complete.
+// Every platform manifest for which hasImage reports true is pushed by digest, and the original
+// index is pushed once all of its manifests exist in the target, which lets nodes of different
+// architectures complete the index together. Until then incomplete platforms exist by digest only;
+// a missing tag gets the local platform as a stand-in so that pulls work on it, but an existing tag
+// is left to the node that completes the index and the restore fails with ErrIncompleteIndex.
+func (c *Client) pushIndex(ctx context.Context, checker *blobChecker, index v1.ImageIndex, ref name.Reference, hasImage func(v1.Hash) bool) error {
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return fmt.Errorf("failed to read image index: %w", err)
+	}
+
+	var (
+		local   v1.Image
+		missing []string
+	)
+	for _, child := range indexManifest.Manifests {
+		childRef := ref.Context().Digest(child.Digest.String())
+		platform := platformString(child.Platform)
+
+		if child.MediaType.IsImage() && hasImage(child.Digest) {
+			img, err := index.Image(child.Digest)
+			if err != nil {
+				return fmt.Errorf("failed to load platform %s: %w", platform, err)
+			}
+			if err := c.writeImage(ctx, checker, childRef, img); err != nil {
+				return fmt.Errorf("failed to push platform %s: %w", platform, err)
+			}
+			c.logger.Debug().
+				Str("target", childRef.String()).
+				Str("platform", platform).
+				Msg("Pushed platform manifest from container runtime")
+			if local == nil {
+				local = img
+			}
+			continue
+		}
+
+		// Another node may already have restored this platform
+		if digest, err := c.remoteDigest(ctx, childRef.String()); err == nil && digest != "" {
+			continue
+		}
+		missing = append(missing, platform)
+	}
+
+	if len(missing) == 0 {
+		if err := remote.Put(ref, index, c.remoteOptions(ctx)...); err != nil {
+			return fmt.Errorf("failed to push image index to registry: %w", err)
+		}
+		return nil
+	}
+
+	c.logger.Warn().
+		Str("target", ref.String()).
+		Strs("missing_platforms", missing).
+		Msg("Image index cannot be restored under its original digest, platforms are not available")
+	metrics.PlatformsUnrecovered.WithLabelValues(c.targetRegistry).Add(float64(len(missing)))
+	if c.recorder != nil {
+		c.recorder.Event("Warning", "IncompleteImageIndex", fmt.Sprintf(
+			"%s restored without platforms %s", ref.String(), strings.Join(missing, ", ")))
+	}
+
+	incomplete := fmt.Errorf("%w: missing platforms %s", ErrIncompleteIndex, strings.Join(missing, ", "))
+	tag, isTag := ref.(name.Tag)
+	if local == nil || !isTag {
+		return incomplete
+	}
+	// Nodes of other architectures would otherwise keep moving the tag to their own platform
+	digest, err := c.remoteDigest(ctx, tag.String())
+	if err != nil {
+		return fmt.Errorf("failed to check target tag: %w", err)
+	}
+	if digest != "" {
+		return incomplete
+	}
+	// Keep at least the local platform pullable under its tag
+	if err := c.writeImage(ctx, checker, tag, local); err != nil {
+		return fmt.Errorf("failed to push image to registry: %w", err)
+	}
+
+	return nil
+}
+
+// isPartialIndex reports whether digest, the content of the target tag, is a platform manifest of
+// the image index that runs as sourceRef. That is the stand-in of an incomplete index restore,
+// which is completed under the tag rather than reported as drift.
+func (c *Client) isPartialIndex(ctx context.Context, sourceRef, targetRef *ImageRef, digest string) bool {
+	if targetRef.Digest == "" || !c.IsTargetImage(sourceRef.FullRef) {
+		return false
+	}
+	runtimeImage, err := RuntimeImageName(sourceRef.DigestRef())
+	if err != nil {
+		return false
+	}
+	local, err := c.LocalImage(ctx, runtimeImage)
+	if err != nil || local.Digest != targetRef.Digest {
+		return false
+	}
+	for _, platform := range local.Platforms {
+		if platform.Digest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// platformString formats a platform for logs, e.g. linux/arm64/v8
+func platformString(platform *v1.Platform) string {
+	if platform == nil {
+		return "unknown"
+	}
+	return platform.String()
+}
+
+// nodePlatform returns the platform of the node, which is the platform the syncer was built for
+func nodePlatform() v1.Platform {
+	platform := v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if info, ok := debug.ReadBuildInfo(); ok && runtime.GOARCH == "arm" {
+		for _, setting := range info.Settings {
+			if setting.Key == "GOARM" {
+				platform.Variant = "v" + strings.SplitN(setting.Value, ",", 2)[0]
+			}
+		}
+	}
+	return platform
+}
+
+// samePlatform reports whether two platforms run the same images, treating an omitted variant
+// as the architecture's default like containerd does, e.g. arm64 as arm64/v8
+func samePlatform(a, b v1.Platform) bool {
+	return a.OS == b.OS && a.Architecture == b.Architecture &&
+		platformVariant(a) == platformVariant(b)
+}
+
+// platformVariant returns the variant of a platform, or the default variant of its architecture
+func platformVariant(platform v1.Platform) string {
+	if platform.Variant != "" {
+		return platform.Variant
+	}
+	switch platform.Architecture {
+	case "arm64":
+		return "v8"
+	case "arm":
+		return "v7"
+	}
+	return ""
+}
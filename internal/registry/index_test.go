@@ -0,0 +1,127 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestPushIndex(t *testing.T) {
+	ctx := context.Background()
+	index, err := random.Index(256, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDigest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := manifest.Manifests[0].Digest
+	onlyLocal := func(digest v1.Hash) bool { return digest == local }
+	all := func(v1.Hash) bool { return true }
+
+	// push runs pushIndex for image in a fresh registry, after setup
+	push := func(t *testing.T, image string, hasImage func(v1.Hash) bool, setup func(*Client, string)) (*Client, string, error) {
+		t.Helper()
+		client, host := newLocalRegistry(t)
+		if setup != nil {
+			setup(client, host)
+		}
+		ref, err := name.ParseReference(host + image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checker, err := client.newBlobChecker(ctx, ref.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, host, client.pushIndex(ctx, checker, index, ref, hasImage)
+	}
+	digestOf := func(t *testing.T, client *Client, image string) string {
+		t.Helper()
+		digest, err := client.remoteDigest(ctx, image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+
+	t.Run("complete index", func(t *testing.T) {
+		client, host, err := push(t, "/org/app:v1", all, nil)
+		if err != nil {
+			t.Fatalf("pushIndex() error = %v", err)
+		}
+		if got := digestOf(t, client, host+"/org/app:v1"); got != indexDigest.String() {
+			t.Errorf("tag resolves to %s, want the index %s", got, indexDigest)
+		}
+	})
+
+	t.Run("incomplete index with a missing tag", func(t *testing.T) {
+		client, host, err := push(t, "/org/app:v1", onlyLocal, nil)
+		if err != nil {
+			t.Fatalf("pushIndex() error = %v", err)
+		}
+		if got := digestOf(t, client, host+"/org/app:v1"); got != local.String() {
+			t.Errorf("tag resolves to %s, want the local platform %s", got, local)
+		}
+	})
+
+	t.Run("incomplete index with an existing tag", func(t *testing.T) {
+		var existing string
+		client, host, err := push(t, "/org/app:v1", onlyLocal, func(client *Client, host string) {
+			existing = pushTestImage(t, client, host+"/org/app:v1")
+		})
+		if !errors.Is(err, ErrIncompleteIndex) {
+			t.Fatalf("pushIndex() error = %v, want ErrIncompleteIndex", err)
+		}
+		if got := digestOf(t, client, host+"/org/app:v1"); got != existing {
+			t.Errorf("tag resolves to %s, want it left at %s", got, existing)
+		}
+		if got := digestOf(t, client, host+"/org/app@"+local.String()); got != local.String() {
+			t.Errorf("local platform is not pushed by digest")
+		}
+	})
+
+	t.Run("incomplete index by digest", func(t *testing.T) {
+		_, _, err := push(t, "/org/app@"+indexDigest.String(), onlyLocal, nil)
+		if !errors.Is(err, ErrIncompleteIndex) {
+			t.Fatalf("pushIndex() error = %v, want ErrIncompleteIndex", err)
+		}
+	})
+
+	t.Run("platforms restored by other nodes", func(t *testing.T) {
+		client, host, err := push(t, "/org/app:v1", onlyLocal, func(client *Client, host string) {
+			for _, child := range manifest.Manifests[1:] {
+				img, err := index.Image(child.Digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ref, err := name.ParseReference(host + "/org/app@" + child.Digest.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				checker, err := client.newBlobChecker(ctx, ref.Context())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := client.writeImage(ctx, checker, ref, img); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+		if err != nil {
+			t.Fatalf("pushIndex() error = %v", err)
+		}
+		if got := digestOf(t, client, host+"/org/app:v1"); got != indexDigest.String() {
+			t.Errorf("tag resolves to %s, want the completed index %s", got, indexDigest)
+		}
+	})
+}
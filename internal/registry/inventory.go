@@ -0,0 +1,329 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// attestationReferenceType marks the attestation manifests BuildKit adds to image indexes
+const attestationReferenceType = "attestation-manifest"
+
+// LocalImage describes an image stored in the node's container runtime
+type LocalImage struct {
+	// Names are the references the runtime stores the image under
+	Names []string `json:"names"`
+	// ID is the runtime's image ID, empty for containerd
+	ID string `json:"id,omitempty"`
+	// Digest is the manifest or image index digest, empty if the runtime does not know it
+	Digest string `json:"digest,omitempty"`
+	// Namespace is the containerd namespace holding the image
+	Namespace string `json:"namespace,omitempty"`
+	// Size is the size of the image's content held locally
+	Size      int64           `json:"size"`
+	Platforms []LocalPlatform `json:"platforms"`
+	// Complete reports whether the content of every platform is held locally
+	Complete bool `json:"complete"`
+}
+
+// LocalPlatform describes one platform of a local image
+type LocalPlatform struct {
+	Platform string `json:"platform"`
+	Digest   string `json:"digest,omitempty"`
+	// Size is the size of the platform's content held locally
+	Size     int64 `json:"size"`
+	Complete bool  `json:"complete"`
+	// MissingBlobs lists content that was garbage collected: blob digests, or layer IDs for containers/storage
+	MissingBlobs []string `json:"missingBlobs,omitempty"`
+}
+
+// Restorable reports whether at least one platform of the image can be pushed from local content
+func (i LocalImage) Restorable() bool {
+	for _, platform := range i.Platforms {
+		if platform.Complete {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalImages lists the images stored in the node's container runtime
+func (c *Client) LocalImages(ctx context.Context) ([]LocalImage, error) {
+	switch c.runtimeType {
+	case RuntimeContainerd:
+		return c.containerdImages(ctx)
+	case RuntimeDocker, RuntimePodman:
+		summaries, err := c.docker.ListImages(ctx)
+		if err != nil {
+			return nil, err
+		}
+		images := make([]LocalImage, 0, len(summaries))
+		for _, summary := range summaries {
+			// Summaries carry no platform
+			image, err := c.docker.InspectImage(ctx, summary.ID)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, dockerLocalImage(image))
+		}
+		return images, nil
+	case RuntimeCRIO:
+		records, err := c.cri.ListImages(ctx)
+		if err != nil {
+			return nil, err
+		}
+		images := make([]LocalImage, 0, len(records))
+		for _, record := range records {
+			images = append(images, c.criLocalImage(record))
+		}
+		return images, nil
+	default:
+		return nil, fmt.Errorf("unsupported runtime type: %s", c.runtimeType)
+	}
+}
+
+// LocalImage returns the node's record of an image, or an error wrapping ErrImageNotPresent
+func (c *Client) LocalImage(ctx context.Context, imageName string) (*LocalImage, error) {
+	var image LocalImage
+	switch c.runtimeType {
+	case RuntimeContainerd:
+		record, namespace, err := c.containerd.Image(ctx, imageName)
+		if err != nil {
+			return nil, err
+		}
+		if image, err = c.containerdLocalImage(ctx, record, namespace); err != nil {
+			return nil, err
+		}
+	case RuntimeDocker, RuntimePodman:
+		record, err := c.docker.InspectImage(ctx, imageName)
+		if err != nil {
+			return nil, err
+		}
+		image = dockerLocalImage(record)
+	case RuntimeCRIO:
+		record, err := c.cri.ImageStatus(ctx, imageName)
+		if err != nil {
+			return nil, err
+		}
+		image = c.criLocalImage(record)
+	default:
+		return nil, fmt.Errorf("unsupported runtime type: %s", c.runtimeType)
+	}
+	return &image, nil
+}
+
+// containerdImages lists the images of all configured namespaces, merging names that share a digest
+func (c *Client) containerdImages(ctx context.Context) ([]LocalImage, error) {
+	var images []LocalImage
+	for _, namespace := range c.containerd.namespaces {
+		records, err := c.containerd.inNamespace(namespace).ListImages(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		byDigest := make(map[string]int)
+		for _, record := range records {
+			if i, ok := byDigest[record.Target.Digest]; ok {
+				images[i].Names = append(images[i].Names, record.Name)
+				continue
+			}
+			image, err := c.containerdLocalImage(ctx, record, namespace)
+			if err != nil {
+				return nil, err
+			}
+			byDigest[record.Target.Digest] = len(images)
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// containerdLocalImage walks an image record through the content store of its namespace
+func (c *Client) containerdLocalImage(ctx context.Context, record *imagesapi.Image, namespace string) (LocalImage, error) {
+	desc, err := recordDescriptor(record)
+	if err != nil {
+		return LocalImage{}, err
+	}
+
+	src := &contentStore{ctx: ctx, client: c.containerd.inNamespace(namespace)}
+	platforms, err := inventoryDescriptor(src, desc, nil)
+	if err != nil {
+		return LocalImage{}, fmt.Errorf("failed to inspect image %s: %w", record.Name, err)
+	}
+	return newLocalImage(LocalImage{
+		Names:     []string{record.Name},
+		Digest:    desc.Digest.String(),
+		Namespace: namespace,
+	}, platforms), nil
+}
+
+// recordDescriptor returns the descriptor a containerd image record points to
+func recordDescriptor(record *imagesapi.Image) (v1.Descriptor, error) {
+	digest, err := v1.NewHash(record.Target.Digest)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("invalid digest for image %s: %w", record.Name, err)
+	}
+	return v1.Descriptor{
+		MediaType: types.MediaType(record.Target.MediaType),
+		Digest:    digest,
+		Size:      record.Target.Size,
+	}, nil
+}
+
+// inventoryDescriptor reports the platforms of the image or image index under desc and the blobs missing from src
+func inventoryDescriptor(src blobSource, desc v1.Descriptor, platform *v1.Platform) ([]LocalPlatform, error) {
+	if !src.has(desc.Digest) {
+		return []LocalPlatform{{
+			Platform:     platformString(platform),
+			Digest:       desc.Digest.String(),
+			MissingBlobs: []string{desc.Digest.String()},
+		}}, nil
+	}
+	raw, err := src.readAll(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if desc.MediaType.IsIndex() {
+		index, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse image index %s: %w", desc.Digest, err)
+		}
+		var platforms []LocalPlatform
+		for _, child := range index.Manifests {
+			if child.Annotations["vnd.docker.reference.type"] == attestationReferenceType {
+				continue
+			}
+			childPlatforms, err := inventoryDescriptor(src, child, child.Platform)
+			if err != nil {
+				return nil, err
+			}
+			platforms = append(platforms, childPlatforms...)
+		}
+		return platforms, nil
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", desc.Digest, err)
+	}
+	local := LocalPlatform{Digest: desc.Digest.String(), Size: int64(len(raw))}
+	for _, blob := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+		if !src.has(blob.Digest) {
+			local.MissingBlobs = append(local.MissingBlobs, blob.Digest.String())
+			continue
+		}
+		local.Size += blob.Size
+	}
+	local.Complete = len(local.MissingBlobs) == 0
+
+	// Images pulled for a single platform carry it only in their config
+	if platform == nil && src.has(manifest.Config.Digest) {
+		if config, err := src.readAll(manifest.Config.Digest); err == nil {
+			if configFile, err := v1.ParseConfigFile(bytes.NewReader(config)); err == nil {
+				platform = configFile.Platform()
+			}
+		}
+	}
+	local.Platform = platformString(platform)
+	return []LocalPlatform{local}, nil
+}
+
+// dockerLocalImage describes an image of the Docker Engine API; the engine keeps all of an image's layers
+func dockerLocalImage(record *dockerImage) LocalImage {
+	var names []string
+	for _, tag := range record.RepoTags {
+		if tag != "<none>:<none>" {
+			names = append(names, tag)
+		}
+	}
+	platform := v1.Platform{OS: record.Os, Architecture: record.Architecture, Variant: record.Variant}
+	return newLocalImage(LocalImage{
+		Names:  names,
+		ID:     record.ID,
+		Digest: firstRepoDigest(record.RepoDigests),
+	}, []LocalPlatform{{
+		Platform: platformString(&platform),
+		Size:     record.Size,
+		Complete: true,
+	}})
+}
+
+// criLocalImage describes an image of a CRI runtime, checking its layers in containers/storage
+func (c *Client) criLocalImage(record *criapi.Image) LocalImage {
+	local := LocalPlatform{Platform: platformString(nil), Size: int64(record.GetSize())}
+
+	store := &containersStorage{root: c.containersStorage}
+	image, err := store.image(strings.TrimPrefix(record.Id, "sha256:"))
+	if err == nil {
+		local.MissingBlobs = store.missingLayers(image)
+		if _, manifest, err := store.manifest(image); err == nil {
+			if config, err := store.bigData(image.ID, manifest.Config.Digest.String()); err == nil {
+				if configFile, err := v1.ParseConfigFile(bytes.NewReader(config)); err == nil {
+					local.Platform = platformString(configFile.Platform())
+				}
+			}
+		}
+	} else {
+		local.MissingBlobs = []string{record.Id}
+	}
+	local.Complete = len(local.MissingBlobs) == 0
+
+	return newLocalImage(LocalImage{
+		Names:  record.RepoTags,
+		ID:     record.Id,
+		Digest: firstRepoDigest(record.RepoDigests),
+	}, []LocalPlatform{local})
+}
+
+// missingLayers returns the IDs of an image's layers whose content can no longer be reassembled
+func (s *containersStorage) missingLayers(image *storageImage) []string {
+	layers, err := s.layers(image.TopLayer)
+	if err != nil {
+		return []string{image.TopLayer}
+	}
+
+	var missing []string
+	for _, layer := range layers {
+		for _, path := range []string{
+			filepath.Join(s.root, "overlay-layers", layer.ID+".tar-split.gz"),
+			filepath.Join(s.root, "overlay", layer.ID, "diff"),
+		} {
+			if _, err := os.Stat(path); err != nil {
+				missing = append(missing, layer.ID)
+				break
+			}
+		}
+	}
+	return missing
+}
+
+// newLocalImage completes an image description from its platforms
+func newLocalImage(image LocalImage, platforms []LocalPlatform) LocalImage {
+	image.Platforms = platforms
+	image.Complete = len(platforms) > 0
+	for _, platform := range platforms {
+		image.Size += platform.Size
+		image.Complete = image.Complete && platform.Complete
+	}
+	return image
+}
+
+// firstRepoDigest returns the digest of the first well-formed repo digest
+func firstRepoDigest(repoDigests []string) string {
+	for _, repoDigest := range repoDigests {
+		if ref, err := name.NewDigest(repoDigest); err == nil {
+			return ref.DigestStr()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ErrMappingConflict is returned when a source repository would be mapped onto a target
+// repository that another source repository already maps to
+var ErrMappingConflict = errors.New("target repository is already mapped from another source")
+
+// dockerHubRegistry is the registry name Docker Hub images are matched and templated with
+const dockerHubRegistry = "docker.io"
+
+// templateVar matches a {{variable}} in a mapping template
+var templateVar = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// MappingRule maps source repositories onto a repository path in the target registry.
+// A rule matches by Prefix or by Regex on the source name (registry/repository, with
+// Docker Hub as docker.io), and Target is expanded with:
+//
+//	{{registry}}  the source registry host, e.g. quay.io
+//	{{repo}}      the source repository path, e.g. foo/bar
+//	{{path}}      the part of the source name after Prefix
+//	{{1}}, {{2}}  groups of Regex
+type MappingRule struct {
+	Prefix string `json:"prefix,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+	Target string `json:"target"`
+
+	regex *regexp.Regexp
+}
+
+// ParseMappingRules parses and validates an ordered JSON list of mapping rules
+func ParseMappingRules(data string) ([]MappingRule, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+
+	var rules []MappingRule
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse mapping rules: %w", err)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("invalid mapping rule %d: %w", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// compile checks that the rule has exactly one matcher and a valid target template
+func (r *MappingRule) compile() error {
+	if (r.Prefix == "") == (r.Regex == "") {
+		return fmt.Errorf("exactly one of prefix and regex must be set")
+	}
+	if r.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+
+	groups := 0
+	if r.Regex != "" {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+		r.regex = re
+		groups = re.NumSubexp()
+	}
+
+	for _, match := range templateVar.FindAllStringSubmatch(r.Target, -1) {
+		switch variable := match[1]; variable {
+		case "registry", "repo":
+		case "path":
+			if r.Prefix == "" {
+				return fmt.Errorf("{{path}} is only available to prefix rules")
+			}
+		default:
+			if n, err := strconv.Atoi(variable); err != nil || n < 1 || n > groups {
+				return fmt.Errorf("unknown template variable {{%s}}", variable)
+			}
+		}
+	}
+	return nil
+}
+
+// apply returns the target repository path for a source, and whether the rule matches it
+func (r *MappingRule) apply(registry, repo string) (string, bool) {
+	source := registry + "/" + repo
+	vars := map[string]string{"registry": registry, "repo": repo}
+
+	if r.regex != nil {
+		groups := r.regex.FindStringSubmatch(source)
+		if groups == nil {
+			return "", false
+		}
+		for i, group := range groups[1:] {
+			vars[strconv.Itoa(i+1)] = group
+		}
+	} else {
+		// A prefix matches whole path segments: docker.io/lib does not match docker.io/library/nginx
+		prefix := strings.TrimSuffix(r.Prefix, "/")
+		if source != prefix && !strings.HasPrefix(source, prefix+"/") {
+			return "", false
+		}
+		vars["path"] = strings.TrimPrefix(strings.TrimPrefix(source, prefix), "/")
+	}
+
+	target := templateVar.ReplaceAllStringFunc(r.Target, func(match string) string {
+		return vars[templateVar.FindStringSubmatch(match)[1]]
+	})
+	return strings.Trim(target, "/"), true
+}
+
+// repositoryMapper maps source repositories to target repositories and refuses
+// to map two sources onto the same target.
+//
+// Conflicts are only detected between the sources this process has seen, in memory: a
+// conflict between sources discovered on different nodes goes unnoticed, and a source
+// synced before its conflicting source was discovered has already been pushed.
+type repositoryMapper struct {
+	rules []MappingRule
+
+	mu        sync.Mutex
+	sources   map[string]string // target repository -> source repository
+	conflicts map[string]string // target repository -> conflicting sources
+}
+
+// newRepositoryMapper creates a mapper applying the first matching rule, or keeping the
+// repository path when none matches
+func newRepositoryMapper(rules []MappingRule) *repositoryMapper {
+	return &repositoryMapper{
+		rules:     rules,
+		sources:   make(map[string]string),
+		conflicts: make(map[string]string),
+	}
+}
+
+// targetRepository returns the repository path in the target registry for a source repository
+func (m *repositoryMapper) targetRepository(ref *ImageRef) string {
+	registry := ref.Registry
+	if registry == name.DefaultRegistry {
+		registry = dockerHubRegistry
+	}
+	for i := range m.rules {
+		if target, ok := m.rules[i].apply(registry, ref.Repository); ok {
+			return target
+		}
+	}
+	return ref.Repository
+}
+
+// claim records that source maps onto target, failing if another source does too. Once two
+// sources conflict both of them fail, so that the outcome does not depend on discovery order.
+func (m *repositoryMapper) claim(source, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if conflicting, ok := m.conflicts[target]; ok {
+		return fmt.Errorf("%w: %s map to %s", ErrMappingConflict, conflicting, target)
+	}
+	if existing, ok := m.sources[target]; ok && existing != source {
+		m.conflicts[target] = existing + " and " + source
+		return fmt.Errorf("%w: %s and %s both map to %s", ErrMappingConflict, existing, source, target)
+	}
+	m.sources[target] = source
+	return nil
+}
+
+// SetMappingRules sets the ordered rules that map source repositories into the target registry
+func (c *Client) SetMappingRules(rules []MappingRule) {
+	c.mapper = newRepositoryMapper(rules)
+}
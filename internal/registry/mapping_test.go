@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMappingRuleApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     string
+		image     string
+		want      string
+		wantMatch bool
+	}{
+		{
+			name:      "prefix with trailing slash",
+			rules:     `[{"prefix": "quay.io/", "target": "quay/{{path}}"}]`,
+			image:     "quay.io/prometheus/node-exporter:v1.8.0",
+			want:      "quay/prometheus/node-exporter",
+			wantMatch: true,
+		},
+		{
+			name:      "prefix without trailing slash",
+			rules:     `[{"prefix": "docker.io/library", "target": "hub/{{path}}"}]`,
+			image:     "nginx:1.27",
+			want:      "hub/nginx",
+			wantMatch: true,
+		},
+		{
+			name:      "prefix matches only whole path segments",
+			rules:     `[{"prefix": "docker.io/lib", "target": "hub/{{path}}"}]`,
+			image:     "nginx:1.27",
+			want:      "library/nginx",
+			wantMatch: false,
+		},
+		{
+			name:      "prefix equal to the source",
+			rules:     `[{"prefix": "ghcr.io/org/app", "target": "apps/app{{path}}"}]`,
+			image:     "ghcr.io/org/app:v1",
+			want:      "apps/app",
+			wantMatch: true,
+		},
+		{
+			name:      "registry and repo variables",
+			rules:     `[{"prefix": "ghcr.io", "target": "mirror/{{registry}}/{{repo}}"}]`,
+			image:     "ghcr.io/org/app:v1",
+			want:      "mirror/ghcr.io/org/app",
+			wantMatch: true,
+		},
+		{
+			name:      "regex groups",
+			rules:     `[{"regex": "^([^/]+)/team-(\\w+)/(.*)$", "target": "{{2}}/{{3}}"}]`,
+			image:     "registry.example.com/team-payments/api:v2",
+			want:      "payments/api",
+			wantMatch: true,
+		},
+		{
+			name:      "regex without a match",
+			rules:     `[{"regex": "^quay\\.io/", "target": "quay/{{repo}}"}]`,
+			image:     "ghcr.io/org/app:v1",
+			want:      "org/app",
+			wantMatch: false,
+		},
+		{
+			name: "first matching rule wins",
+			rules: `[{"prefix": "ghcr.io/org", "target": "org/{{path}}"},
+			         {"prefix": "ghcr.io", "target": "ghcr/{{path}}"}]`,
+			image:     "ghcr.io/org/app:v1",
+			want:      "org/app",
+			wantMatch: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseMappingRules(tt.rules)
+			if err != nil {
+				t.Fatalf("ParseMappingRules() error = %v", err)
+			}
+			ref, err := ParseImageRef(tt.image)
+			if err != nil {
+				t.Fatalf("ParseImageRef() error = %v", err)
+			}
+
+			registry := ref.Registry
+			if registry == "index.docker.io" {
+				registry = dockerHubRegistry
+			}
+			matched := false
+			for i := range rules {
+				if _, ok := rules[i].apply(registry, ref.Repository); ok {
+					matched = true
+					break
+				}
+			}
+			if matched != tt.wantMatch {
+				t.Errorf("rule matched = %v, want %v", matched, tt.wantMatch)
+			}
+			if got := newRepositoryMapper(rules).targetRepository(ref); got != tt.want {
+				t.Errorf("targetRepository() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMappingRulesInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{name: "no matcher", rules: `[{"target": "x"}]`},
+		{name: "both matchers", rules: `[{"prefix": "a", "regex": "b", "target": "x"}]`},
+		{name: "no target", rules: `[{"prefix": "a"}]`},
+		{name: "invalid regex", rules: `[{"regex": "(", "target": "x"}]`},
+		{name: "path in regex rule", rules: `[{"regex": "a", "target": "{{path}}"}]`},
+		{name: "unknown group", rules: `[{"regex": "(a)", "target": "{{2}}"}]`},
+		{name: "unknown variable", rules: `[{"prefix": "a", "target": "{{tag}}"}]`},
+		{name: "not a list", rules: `{"prefix": "a"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseMappingRules(tt.rules); err == nil {
+				t.Errorf("ParseMappingRules(%s) succeeded, want an error", tt.rules)
+			}
+		})
+	}
+}
+
+func TestRepositoryMapperClaim(t *testing.T) {
+	m := newRepositoryMapper(nil)
+
+	if err := m.claim("quay.io/org/app", "registry.example.com/app"); err != nil {
+		t.Fatalf("first claim: %v", err)
+	}
+	if err := m.claim("quay.io/org/app", "registry.example.com/app"); err != nil {
+		t.Fatalf("repeated claim by the same source: %v", err)
+	}
+	if err := m.claim("ghcr.io/org/app", "registry.example.com/app"); !errors.Is(err, ErrMappingConflict) {
+		t.Fatalf("conflicting claim error = %v, want ErrMappingConflict", err)
+	}
+	// Once conflicting, the first source fails too, whatever the discovery order was
+	if err := m.claim("quay.io/org/app", "registry.example.com/app"); !errors.Is(err, ErrMappingConflict) {
+		t.Fatalf("claim after conflict error = %v, want ErrMappingConflict", err)
+	}
+	if err := m.claim("quay.io/org/other", "registry.example.com/other"); err != nil {
+		t.Fatalf("unrelated claim: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ownedRegistries maps the registry hosts whose images can only be restored from a container
+// runtime to the repository path prefix in the target registry they are restored under, empty
+// for restoring them under their own repository path
+type ownedRegistries map[string]string
+
+// NormalizeRegistryHost parses a registry host with an optional port, as it appears in image references,
+// e.g. "https://Docker.io/" becomes "index.docker.io"
+func NormalizeRegistryHost(host string) (string, error) {
+	host = strings.TrimSpace(host)
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host = strings.TrimSuffix(host, "/")
+	if host == "" || strings.Contains(host, "/") {
+		return "", fmt.Errorf("invalid registry host %q", host)
+	}
+
+	registry, err := name.NewRegistry(strings.ToLower(host))
+	if err != nil {
+		return "", fmt.Errorf("invalid registry host %q: %w", host, err)
+	}
+	return registry.RegistryStr(), nil
+}
+
+// targetHostAndPath splits the target registry URL into its host and an optional repository path prefix
+func targetHostAndPath(targetRegistry string) (string, string) {
+	host, path, _ := strings.Cut(targetRegistry, "/")
+	return host, path
+}
+
+// SetOwnedRegistries adds registry hosts whose images are restored into the target registry,
+// such as aliases of the target or the same host with an explicit port. A host may name where its
+// images are restored as host=path, e.g. "registry.internal:5000=internal" restores
+// registry.internal:5000/team/app into <target>/internal/team/app; without a path images keep
+// their own repository path. The target registry's own host is always owned.
+func (c *Client) SetOwnedRegistries(hosts []string) error {
+	owned := make(ownedRegistries, len(hosts)+1)
+	targetHost, _ := targetHostAndPath(c.targetRegistry)
+	for _, entry := range append([]string{targetHost}, hosts...) {
+		host, path, _ := strings.Cut(entry, "=")
+		normalized, err := NormalizeRegistryHost(host)
+		if err != nil {
+			return err
+		}
+		path = strings.Trim(strings.TrimSpace(path), "/")
+		if path != "" {
+			if _, err := name.NewRepository(c.targetRegistry + "/" + path); err != nil {
+				return fmt.Errorf("invalid destination %q for owned registry %s: %w", path, normalized, err)
+			}
+		}
+		owned[normalized] = path
+	}
+	c.owned = owned
+	return nil
+}
+
+// OwnedRegistries returns the registry hosts whose images are restored into the target registry,
+// with the path they are restored under if they have one
+func (c *Client) OwnedRegistries() []string {
+	hosts := make([]string, 0, len(c.owned))
+	for host, path := range c.owned {
+		if path != "" {
+			host += "=" + path
+		}
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// IsTargetImage reports whether an image is hosted on a registry owned by the target,
+// i.e. it can only be restored from a container runtime, not copied
+func (c *Client) IsTargetImage(image string) bool {
+	ref, err := ParseImageRef(image)
+	if err != nil {
+		return false
+	}
+	_, ok := c.owned[strings.ToLower(ref.Registry)]
+	return ok
+}
+
+// ownedRepository returns the repository path in the target registry that an image from an
+// owned registry is restored to: under the destination of its host if it has one, otherwise its
+// own path, without the target URL's path prefix it already carries
+func (c *Client) ownedRepository(ref *ImageRef) string {
+	if destination := c.owned[strings.ToLower(ref.Registry)]; destination != "" {
+		return destination + "/" + ref.Repository
+	}
+	_, path := targetHostAndPath(c.targetRegistry)
+	if path != "" {
+		if repo, ok := strings.CutPrefix(ref.Repository, path+"/"); ok {
+			return repo
+		}
+	}
+	return ref.Repository
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// newOwnedClient returns a client for targetRegistry that owns hosts
+func newOwnedClient(t *testing.T, targetRegistry string, hosts ...string) *Client {
+	t.Helper()
+	client, err := NewClient(targetRegistry, "user", "password", "", RuntimeType(""), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetOwnedRegistries(hosts); err != nil {
+		t.Fatalf("SetOwnedRegistries() error = %v", err)
+	}
+	return client
+}
+
+func TestSetOwnedRegistries(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "target host only", want: []string{"registry.lab"}},
+		{
+			name:  "normalized hosts and destinations",
+			hosts: []string{"https://Registry.Internal:5000/=/internal/", "docker.io", " alias.lab "},
+			want:  []string{"alias.lab", "index.docker.io", "registry.internal:5000=internal", "registry.lab"},
+		},
+		{name: "host with a path", hosts: []string{"registry.internal/team"}, wantErr: true},
+		{name: "invalid host", hosts: []string{"registry internal"}, wantErr: true},
+		{name: "invalid destination", hosts: []string{"registry.internal=Team App"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClient("registry.lab/mirror", "user", "password", "", RuntimeType(""), zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.SetOwnedRegistries(tt.hosts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetOwnedRegistries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !slices.Equal(client.OwnedRegistries(), tt.want) {
+				t.Errorf("OwnedRegistries() = %v, want %v", client.OwnedRegistries(), tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTargetImage(t *testing.T) {
+	client := newOwnedClient(t, "registry.lab/mirror", "registry.internal:5000=internal", "docker.io")
+
+	tests := []struct {
+		image string
+		want  bool
+	}{
+		{image: "registry.lab/mirror/team/app:v1", want: true},
+		{image: "Registry.lab/team/app:v1", want: true},
+		{image: "registry.internal:5000/team/app:v1", want: true},
+		{image: "registry.internal/team/app:v1", want: false},
+		{image: "nginx:1.27", want: true},
+		{image: "index.docker.io/library/nginx:1.27", want: true},
+		{image: "ghcr.io/org/app:v1", want: false},
+		{image: "not a reference", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := client.IsTargetImage(tt.image); got != tt.want {
+				t.Errorf("IsTargetImage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOwnedRepository(t *testing.T) {
+	client := newOwnedClient(t, "registry.lab/mirror", "registry.internal:5000=internal", "alias.lab")
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		// The target's own images already carry its path prefix
+		{image: "registry.lab/mirror/team/app:v1", want: "team/app"},
+		{image: "registry.lab/team/app:v1", want: "team/app"},
+		{image: "alias.lab/team/app:v1", want: "team/app"},
+		{image: "alias.lab/mirror/team/app:v1", want: "team/app"},
+		// A host with a destination is restored under it
+		{image: "registry.internal:5000/team/app:v1", want: "internal/team/app"},
+		{image: "Registry.Internal:5000/team/app@" + testDigest, want: "internal/team/app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := ParseImageRef(tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := client.ownedRepository(ref); got != tt.want {
+				t.Errorf("ownedRepository() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
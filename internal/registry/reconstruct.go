@@ -0,0 +1,329 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
+)
+
+const (
+	// ReconstructedAnnotation marks manifests whose layers were rebuilt from snapshots
+	ReconstructedAnnotation = "push-missed-images/reconstructed"
+	// SourceDigestAnnotation records the digest of the image, or image index, a reconstructed image replaces
+	SourceDigestAnnotation = "push-missed-images/source-digest"
+
+	// snapshotRefLabelPrefix is followed by the snapshotter name in the labels containerd puts on
+	// the config of an unpacked image
+	snapshotRefLabelPrefix = "containerd.io/gc.ref.snapshot."
+	// uncompressedLabel holds the diff ID of a layer in the content store
+	uncompressedLabel = "containerd.io/uncompressed"
+)
+
+// pushReconstructed rebuilds the layers an image no longer has in the content store by diffing its
+// snapshot chain, and pushes the local platform under ref, or under its recovery tag if ref is a digest.
+// Rebuilt layers do not reproduce the original compressed bytes, so the pushed manifest has a new
+// digest and carries ReconstructedAnnotation.
+func (c *Client) pushReconstructed(ctx context.Context, checker *blobChecker, containerd *containerdClient, desc v1.Descriptor, ref name.Reference, imageName string) error {
+	if digestRef, ok := ref.(name.Digest); ok {
+		if c.recoverer == nil {
+			return fmt.Errorf("%w: layers of %s were garbage collected and a reconstructed image cannot match %s",
+				ErrContentNotFound, imageName, ref.Identifier())
+		}
+		// Workload recovery repins the image to the tag derived from its original digest
+		recovered := recoveryRef(&ImageRef{Repository: digestRef.RepositoryStr(), Digest: digestRef.DigestStr()})
+		ref = digestRef.Context().Tag(recovered.Tag)
+	}
+
+	src := &contentStore{ctx: ctx, client: containerd}
+	manifestDesc, err := localPlatformManifest(src, desc)
+	if err != nil {
+		return err
+	}
+	raw, err := src.readAll(manifestDesc.Digest)
+	if err != nil {
+		return err
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest %s: %w", manifestDesc.Digest, err)
+	}
+	config, err := src.readAll(manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	c.logger.Warn().
+		Str("image", imageName).
+		Str("target", ref.String()).
+		Str("manifest", manifestDesc.Digest.String()).
+		Msg("Layers were garbage collected by containerd, rebuilding them from snapshots")
+
+	rebuilt, err := c.rebuildLayers(ctx, containerd, src, manifestDesc.MediaType, manifest, config)
+	if err != nil {
+		return fmt.Errorf("failed to reconstruct %s: %w", imageName, err)
+	}
+
+	if rebuilt.config != nil {
+		configLayer, err := partial.CompressedToLayer(&archiveBlob{
+			digest:    manifest.Config.Digest,
+			size:      manifest.Config.Size,
+			mediaType: manifest.Config.MediaType,
+			r:         bytes.NewReader(rebuilt.config),
+		})
+		if err != nil {
+			return err
+		}
+		if err := c.writeBlob(ctx, checker, configLayer); err != nil {
+			return fmt.Errorf("failed to push image config: %w", err)
+		}
+	} else if err := c.writeContentBlob(ctx, checker, src, manifest.Config); err != nil {
+		return fmt.Errorf("failed to push image config: %w", err)
+	}
+	for _, layer := range manifest.Layers {
+		if err := c.writeContentBlob(ctx, checker, src, layer); err != nil {
+			return fmt.Errorf("failed to push layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	if manifest.Annotations == nil {
+		manifest.Annotations = map[string]string{}
+	}
+	manifest.Annotations[ReconstructedAnnotation] = "true"
+	manifest.Annotations[SourceDigestAnnotation] = desc.Digest.String()
+	manifestRaw, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := remote.Put(ref, &rawManifest{raw: manifestRaw, mediaType: manifestDesc.MediaType}, c.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("failed to push image to registry: %w", err)
+	}
+
+	digest, _, err := v1.SHA256(bytes.NewReader(manifestRaw))
+	if err != nil {
+		return err
+	}
+	c.logger.Warn().
+		Str("image", imageName).
+		Str("target", ref.String()).
+		Str("source_digest", desc.Digest.String()).
+		Str("digest", digest.String()).
+		Int("rebuilt_layers", rebuilt.layers).
+		Msg("Pushed reconstructed image, its digest differs from the original")
+	metrics.ImagesReconstructed.WithLabelValues(c.targetRegistry).Inc()
+	if c.recorder != nil {
+		c.recorder.Event("Warning", "ImageReconstructed", fmt.Sprintf(
+			"Restored %s with %d layer(s) rebuilt from snapshots; %s now resolves to %s instead of %s",
+			imageName, rebuilt.layers, ref, digest, desc.Digest))
+	}
+	return nil
+}
+
+// reconstructedFrom returns the source digest recorded on a reconstructed target manifest,
+// or an empty string if the manifest was not reconstructed
+func (c *Client) reconstructedFrom(ctx context.Context, image string) string {
+	ref, err := c.parseReference(image)
+	if err != nil {
+		return ""
+	}
+	desc, err := remote.Get(ref, c.remoteOptions(ctx)...)
+	if err != nil || !desc.MediaType.IsImage() {
+		return ""
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(desc.Manifest))
+	if err != nil || manifest.Annotations[ReconstructedAnnotation] != "true" {
+		return ""
+	}
+	return manifest.Annotations[SourceDigestAnnotation]
+}
+
+// rebuiltImage reports what rebuildLayers changed in a manifest
+type rebuiltImage struct {
+	// layers is the number of layers rebuilt from snapshots
+	layers int
+	// config is the rewritten config, nil if the diff IDs did not change
+	config []byte
+}
+
+// rebuildLayers replaces the layers of manifest that are missing from src with layers diffed from
+// the image's snapshots, and rewrites the config's diff IDs to match. The manifest's media type
+// comes from its descriptor, since OCI manifests need not carry it.
+func (c *Client) rebuildLayers(ctx context.Context, containerd *containerdClient, src blobSource, manifestType types.MediaType, manifest *v1.Manifest, config []byte) (*rebuiltImage, error) {
+	configFile, err := v1.ParseConfigFile(bytes.NewReader(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image config: %w", err)
+	}
+	diffIDs := configFile.RootFS.DiffIDs
+	if len(diffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image config lists %d layers but the manifest %d", len(diffIDs), len(manifest.Layers))
+	}
+
+	snapshotter, err := imageSnapshotter(ctx, containerd, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	chain := chainIDs(diffIDs)
+
+	mediaType := types.DockerLayer
+	if manifestType == types.OCIManifestSchema1 {
+		mediaType = types.OCILayer
+	}
+
+	rebuilt := &rebuiltImage{}
+	configChanged := false
+	for i, layer := range manifest.Layers {
+		if src.has(layer.Digest) {
+			continue
+		}
+
+		parent := ""
+		if i > 0 {
+			parent = chain[i-1].String()
+		}
+		desc, diffID, err := diffSnapshot(ctx, containerd, snapshotter, parent, chain[i].String(), mediaType)
+		if err != nil {
+			return nil, err
+		}
+		c.logger.Debug().
+			Str("layer", layer.Digest.String()).
+			Str("rebuilt", desc.Digest.String()).
+			Str("snapshot", chain[i].String()).
+			Msg("Rebuilt layer from snapshot")
+
+		manifest.Layers[i] = desc
+		if diffID != diffIDs[i] {
+			diffIDs[i] = diffID
+			configChanged = true
+		}
+		rebuilt.layers++
+	}
+
+	if configChanged {
+		if rebuilt.config, err = json.Marshal(configFile); err != nil {
+			return nil, err
+		}
+		digest, size, err := v1.SHA256(bytes.NewReader(rebuilt.config))
+		if err != nil {
+			return nil, err
+		}
+		manifest.Config.Digest = digest
+		manifest.Config.Size = size
+	}
+	return rebuilt, nil
+}
+
+// diffSnapshot writes the changes of a committed snapshot over its parent to the content store
+// and returns the new layer's descriptor and diff ID
+func diffSnapshot(ctx context.Context, containerd *containerdClient, snapshotter, parent, snapshot string, mediaType types.MediaType) (v1.Descriptor, v1.Hash, error) {
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	lower, removeLower, err := containerd.View(ctx, snapshotter, "push-missed-images-lower-"+snapshot+"-"+suffix, parent)
+	if err != nil {
+		return v1.Descriptor{}, v1.Hash{}, err
+	}
+	defer removeLower()
+	upper, removeUpper, err := containerd.View(ctx, snapshotter, "push-missed-images-upper-"+snapshot+"-"+suffix, snapshot)
+	if err != nil {
+		return v1.Descriptor{}, v1.Hash{}, err
+	}
+	defer removeUpper()
+
+	diff, err := containerd.Diff(ctx, lower, upper, string(mediaType), "push-missed-images-"+snapshot+"-"+suffix)
+	if err != nil {
+		return v1.Descriptor{}, v1.Hash{}, err
+	}
+	digest, err := v1.NewHash(diff.Digest)
+	if err != nil {
+		return v1.Descriptor{}, v1.Hash{}, fmt.Errorf("invalid digest of rebuilt layer: %w", err)
+	}
+
+	labels, err := containerd.ContentLabels(ctx, diff.Digest)
+	if err != nil {
+		return v1.Descriptor{}, v1.Hash{}, err
+	}
+	diffID, err := v1.NewHash(labels[uncompressedLabel])
+	if err != nil {
+		return v1.Descriptor{}, v1.Hash{}, fmt.Errorf("rebuilt layer %s has no uncompressed digest: %w", digest, err)
+	}
+
+	return v1.Descriptor{MediaType: types.MediaType(diff.MediaType), Digest: digest, Size: diff.Size}, diffID, nil
+}
+
+// imageSnapshotter returns the snapshotter an image was unpacked with, from the labels on its config
+func imageSnapshotter(ctx context.Context, containerd *containerdClient, config v1.Hash) (string, error) {
+	labels, err := containerd.ContentLabels(ctx, config.String())
+	if err != nil {
+		return "", err
+	}
+	for key := range labels {
+		if snapshotter, ok := strings.CutPrefix(key, snapshotRefLabelPrefix); ok {
+			return snapshotter, nil
+		}
+	}
+	return "", fmt.Errorf("%w: image with config %s was never unpacked into snapshots", ErrContentNotFound, config)
+}
+
+// chainIDs computes the snapshot chain IDs of a list of layer diff IDs
+func chainIDs(diffIDs []v1.Hash) []v1.Hash {
+	chain := make([]v1.Hash, len(diffIDs))
+	for i, diffID := range diffIDs {
+		if i == 0 {
+			chain[i] = diffID
+			continue
+		}
+		sum := sha256.Sum256([]byte(chain[i-1].String() + " " + diffID.String()))
+		chain[i] = v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}
+	}
+	return chain
+}
+
+// localPlatformManifest returns the manifest to reconstruct: desc itself, or for an image index the
+// manifest of the node's platform. Snapshots only exist for the platform the node runs, and a
+// reconstruction of another platform must never be pushed in place of the index.
+func localPlatformManifest(src blobSource, desc v1.Descriptor) (v1.Descriptor, error) {
+	if !desc.MediaType.IsIndex() {
+		return desc, nil
+	}
+
+	raw, err := src.readAll(desc.Digest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	index, err := v1.ParseIndexManifest(bytes.NewReader(raw))
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to parse image index %s: %w", desc.Digest, err)
+	}
+
+	node := nodePlatform()
+	for _, child := range index.Manifests {
+		if !child.MediaType.IsImage() || !src.has(child.Digest) {
+			continue
+		}
+		if child.Platform != nil && samePlatform(*child.Platform, node) {
+			return child, nil
+		}
+	}
+	return v1.Descriptor{}, fmt.Errorf("%w: the %s manifest of image index %s is not in the content store",
+		ErrContentNotFound, platformString(&node), desc.Digest)
+}
+
+// writeContentBlob uploads a blob of the content store unless the target repository has it
+func (c *Client) writeContentBlob(ctx context.Context, checker *blobChecker, src blobSource, desc v1.Descriptor) error {
+	layer, err := partial.CompressedToLayer(&contentLayer{store: src, desc: desc})
+	if err != nil {
+		return err
+	}
+	return c.writeBlob(ctx, checker, layer)
+}
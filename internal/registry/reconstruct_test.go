@@ -0,0 +1,375 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	diffapi "github.com/containerd/containerd/api/services/diff/v1"
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	containerdtypes "github.com/containerd/containerd/api/types"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fakeBlob is a blob of the fake containerd content store
+type fakeBlob struct {
+	data   []byte
+	labels map[string]string
+}
+
+// fakeContent serves blobs from memory in place of the containerd content service
+type fakeContent struct {
+	contentapi.ContentClient
+	blobs map[string]fakeBlob
+}
+
+func (f *fakeContent) Info(_ context.Context, in *contentapi.InfoRequest, _ ...grpc.CallOption) (*contentapi.InfoResponse, error) {
+	blob, ok := f.blobs[in.Digest]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "content %s not found", in.Digest)
+	}
+	return &contentapi.InfoResponse{Info: &contentapi.Info{Digest: in.Digest, Size: int64(len(blob.data)), Labels: blob.labels}}, nil
+}
+
+func (f *fakeContent) Read(_ context.Context, in *contentapi.ReadContentRequest, _ ...grpc.CallOption) (contentapi.Content_ReadClient, error) {
+	blob, ok := f.blobs[in.Digest]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "content %s not found", in.Digest)
+	}
+	return &fakeReadStream{data: blob.data}, nil
+}
+
+// fakeReadStream sends a blob in a single message
+type fakeReadStream struct {
+	grpc.ClientStream
+	data []byte
+	sent bool
+}
+
+func (s *fakeReadStream) Recv() (*contentapi.ReadContentResponse, error) {
+	if s.sent {
+		return nil, io.EOF
+	}
+	s.sent = true
+	return &contentapi.ReadContentResponse{Data: s.data}, nil
+}
+
+// fakeSnapshots returns views that mount the snapshot they were created from
+type fakeSnapshots struct {
+	snapshotsapi.SnapshotsClient
+}
+
+func (fakeSnapshots) View(_ context.Context, in *snapshotsapi.ViewSnapshotRequest, _ ...grpc.CallOption) (*snapshotsapi.ViewSnapshotResponse, error) {
+	return &snapshotsapi.ViewSnapshotResponse{Mounts: []*containerdtypes.Mount{{Source: in.Parent}}}, nil
+}
+
+func (fakeSnapshots) Remove(context.Context, *snapshotsapi.RemoveSnapshotRequest, ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+// fakeDiff returns the layer prepared for the upper snapshot of a diff
+type fakeDiff struct {
+	diffapi.DiffClient
+	layers map[string]*containerdtypes.Descriptor
+}
+
+func (f *fakeDiff) Diff(_ context.Context, in *diffapi.DiffRequest, _ ...grpc.CallOption) (*diffapi.DiffResponse, error) {
+	layer, ok := f.layers[in.Right[0].Source]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s not found", in.Right[0].Source)
+	}
+	return &diffapi.DiffResponse{Diff: layer}, nil
+}
+
+// memorySource is a blob source held in memory
+type memorySource map[v1.Hash][]byte
+
+func (m memorySource) readAll(digest v1.Hash) ([]byte, error) {
+	data, ok := m[digest]
+	if !ok {
+		return nil, ErrContentNotFound
+	}
+	return data, nil
+}
+
+func (m memorySource) open(digest v1.Hash) (io.ReadCloser, error) {
+	data, err := m.readAll(digest)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m memorySource) has(digest v1.Hash) bool {
+	_, ok := m[digest]
+	return ok
+}
+
+// layerBlob returns the compressed content and the diff ID of a layer
+func layerBlob(t *testing.T, layer v1.Layer) (v1.Hash, []byte, v1.Hash) {
+	t.Helper()
+	digest, err := layer.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffID, err := layer.DiffID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest, data, diffID
+}
+
+func TestPushReconstructed(t *testing.T) {
+	ctx := context.Background()
+	var (
+		digests [2]v1.Hash
+		data    [2][]byte
+		diffIDs [2]v1.Hash
+	)
+	for i := range digests {
+		layer, err := random.Layer(256, types.OCILayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests[i], data[i], diffIDs[i] = layerBlob(t, layer)
+	}
+	rebuiltLayer, err := random.Layer(256, types.OCILayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuiltDigest, rebuiltData, rebuiltDiffID := layerBlob(t, rebuiltLayer)
+
+	config, err := json.Marshal(v1.ConfigFile{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS:       v1.RootFS{Type: "layers", DiffIDs: diffIDs[:]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An OCI manifest without mediaType, its type is only known from the descriptor
+	manifest, err := json.Marshal(v1.Manifest{
+		SchemaVersion: 2,
+		Config:        v1.Descriptor{MediaType: types.OCIConfigJSON, Digest: configDigest, Size: configSize},
+		Layers: []v1.Descriptor{
+			{MediaType: types.OCILayer, Digest: digests[0], Size: int64(len(data[0]))},
+			{MediaType: types.OCILayer, Digest: digests[1], Size: int64(len(data[1]))},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: manifestDigest, Size: manifestSize}
+
+	// The second layer was discarded after unpacking and is diffed from its snapshot
+	chain := chainIDs(diffIDs[:])
+	containerd := &containerdClient{
+		content: &fakeContent{blobs: map[string]fakeBlob{
+			manifestDigest.String(): {data: manifest},
+			configDigest.String():   {data: config, labels: map[string]string{snapshotRefLabelPrefix + "overlayfs": chain[1].String()}},
+			digests[0].String():     {data: data[0]},
+			rebuiltDigest.String():  {data: rebuiltData, labels: map[string]string{uncompressedLabel: rebuiltDiffID.String()}},
+		}},
+		snapshots: fakeSnapshots{},
+		diff: &fakeDiff{layers: map[string]*containerdtypes.Descriptor{
+			chain[1].String(): {MediaType: string(types.OCILayer), Digest: rebuiltDigest.String(), Size: int64(len(rebuiltData))},
+		}},
+		namespaces: []string{DefaultContainerdNamespace},
+	}
+
+	client, host := newLocalRegistry(t)
+	push := func(image string) error {
+		ref, err := name.ParseReference(host + image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checker, err := client.newBlobChecker(ctx, ref.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.pushReconstructed(ctx, checker, containerd, desc, ref, "registry.example.com"+image)
+	}
+
+	if err := push("/org/app@" + manifestDigest.String()); !errors.Is(err, ErrContentNotFound) {
+		t.Fatalf("pushReconstructed() by digest without recovery error = %v, want ErrContentNotFound", err)
+	}
+	if err := push("/org/app:v1"); err != nil {
+		t.Fatalf("pushReconstructed() error = %v", err)
+	}
+
+	image := host + "/org/app:v1"
+	if got := client.reconstructedFrom(ctx, image); got != manifestDigest.String() {
+		t.Errorf("reconstructedFrom() = %q, want %s", got, manifestDigest)
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := remote.Image(ref, client.remoteOptions(ctx)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType, err := pushed.MediaType(); err != nil || mediaType != types.OCIManifestSchema1 {
+		t.Errorf("pushed manifest media type = %q, %v, want %s", mediaType, err, types.OCIManifestSchema1)
+	}
+	pushedManifest, err := pushed.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pushedManifest.Layers[0].Digest; got != digests[0] {
+		t.Errorf("layer 0 = %s, want the original %s", got, digests[0])
+	}
+	if got := pushedManifest.Layers[1]; got.Digest != rebuiltDigest || got.MediaType != types.OCILayer {
+		t.Errorf("layer 1 = %s %s, want the rebuilt %s %s", got.MediaType, got.Digest, types.OCILayer, rebuiltDigest)
+	}
+	pushedConfig, err := pushed.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pushedConfig.RootFS.DiffIDs; len(got) != 2 || got[0] != diffIDs[0] || got[1] != rebuiltDiffID {
+		t.Errorf("diff IDs = %v, want [%s %s]", got, diffIDs[0], rebuiltDiffID)
+	}
+}
+
+func TestSamePlatform(t *testing.T) {
+	tests := []struct {
+		a, b v1.Platform
+		want bool
+	}{
+		{a: v1.Platform{OS: "linux", Architecture: "amd64"}, b: v1.Platform{OS: "linux", Architecture: "amd64"}, want: true},
+		{a: v1.Platform{OS: "linux", Architecture: "arm64"}, b: v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, want: true},
+		{a: v1.Platform{OS: "linux", Architecture: "arm"}, b: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, want: true},
+		{a: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, b: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, want: false},
+		{a: v1.Platform{OS: "linux", Architecture: "amd64"}, b: v1.Platform{OS: "linux", Architecture: "arm64"}, want: false},
+		{a: v1.Platform{OS: "linux", Architecture: "amd64"}, b: v1.Platform{OS: "windows", Architecture: "amd64"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a.String()+" "+tt.b.String(), func(t *testing.T) {
+			if got := samePlatform(tt.a, tt.b); got != tt.want {
+				t.Errorf("samePlatform() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalPlatformManifest(t *testing.T) {
+	node := nodePlatform()
+	otherVariant := node
+	otherVariant.Variant = "v1"
+	hash := func(b byte) v1.Hash {
+		return v1.Hash{Algorithm: "sha256", Hex: strings.Repeat(string(b), 64)}
+	}
+	wrongVariant := v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: hash('a'), Platform: &otherVariant}
+	local := v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: hash('b'), Platform: &node}
+
+	indexFor := func(t *testing.T, manifests ...v1.Descriptor) (memorySource, v1.Descriptor) {
+		t.Helper()
+		raw, err := json.Marshal(v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex, Manifests: manifests})
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, size, err := v1.SHA256(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := memorySource{digest: raw}
+		for _, manifest := range manifests {
+			src[manifest.Digest] = []byte("{}")
+		}
+		return src, v1.Descriptor{MediaType: types.OCIImageIndex, Digest: digest, Size: size}
+	}
+
+	src, desc := indexFor(t, wrongVariant, local)
+	if got, err := localPlatformManifest(src, desc); err != nil || got.Digest != local.Digest {
+		t.Errorf("localPlatformManifest() = %s, %v, want %s", got.Digest, err, local.Digest)
+	}
+
+	// A different variant of the node's architecture is never reconstructed in its place
+	src, desc = indexFor(t, wrongVariant, local)
+	delete(src, local.Digest)
+	if got, err := localPlatformManifest(src, desc); !errors.Is(err, ErrContentNotFound) {
+		t.Errorf("localPlatformManifest() = %s, %v, want ErrContentNotFound", got.Digest, err)
+	}
+
+	if got, err := localPlatformManifest(src, local); err != nil || got.Digest != local.Digest {
+		t.Errorf("localPlatformManifest() of a manifest = %s, %v, want the manifest itself", got.Digest, err)
+	}
+}
+
+func TestChainIDs(t *testing.T) {
+	hash := func(t *testing.T, digest string) v1.Hash {
+		t.Helper()
+		h, err := v1.NewHash(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	a := "sha256:" + strings.Repeat("a", 64)
+	b := "sha256:" + strings.Repeat("b", 64)
+	c := "sha256:" + strings.Repeat("c", 64)
+	// sha256 of "<chain ID of the parent> <diff ID>", as containerd names its snapshots
+	ab := "sha256:ccd722928bd92476ba1745586fed6e45a102504185ad88cd89e01ff116fd146c"
+	abc := "sha256:c1377126441fb2f5ec2c21ae2a60255331d639e830f0ee1b40a36e52d4c40588"
+
+	tests := []struct {
+		name    string
+		diffIDs []string
+		want    []string
+	}{
+		{name: "no layers", diffIDs: nil, want: []string{}},
+		{name: "base layer is its own chain ID", diffIDs: []string{a}, want: []string{a}},
+		{name: "two layers", diffIDs: []string{a, b}, want: []string{a, ab}},
+		{name: "three layers", diffIDs: []string{a, b, c}, want: []string{a, ab, abc}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffIDs := make([]v1.Hash, len(tt.diffIDs))
+			for i, d := range tt.diffIDs {
+				diffIDs[i] = hash(t, d)
+			}
+
+			got := chainIDs(diffIDs)
+			if len(got) != len(tt.want) {
+				t.Fatalf("chainIDs() returned %d IDs, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i].String() != tt.want[i] {
+					t.Errorf("chainIDs()[%d] = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
+)
+
+// recoveryTagPrefix starts the tag a reconstructed image pinned only by digest is pushed under
+const recoveryTagPrefix = "reconstructed-"
+
+// WorkloadRecoverer points workloads that pin a digest the registry cannot serve any more
+// at the content that was restored instead
+type WorkloadRecoverer interface {
+	// Recover rewrites references to originalImage into restoredImage
+	Recover(ctx context.Context, originalImage, restoredImage string) error
+}
+
+// SetWorkloadRecoverer enables recovery of workloads pinned to digests that a restore could not reproduce
+func (c *Client) SetWorkloadRecoverer(recoverer WorkloadRecoverer) {
+	c.recoverer = recoverer
+}
+
+// recoveryRef returns the tag a restore of ref is pushed under: its own tag, or for references
+// pinned only by digest a tag derived from that digest
+func recoveryRef(ref *ImageRef) *ImageRef {
+	if ref.Tag != "" || ref.Digest == "" {
+		return ref
+	}
+	hex := ref.Digest[strings.Index(ref.Digest, ":")+1:]
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return &ImageRef{Registry: ref.Registry, Repository: ref.Repository, Tag: recoveryTagPrefix + hex}
+}
+
+// checkRestoredDigest warns when a restore did not reproduce the digest that runs in the cluster
+// and, if sourceImage pins that digest, hands the workloads using it to the recoverer
+func (c *Client) checkRestoredDigest(ctx context.Context, sourceImage string, targetRef *ImageRef) {
+	pushed := recoveryRef(targetRef)
+	if pushed.Tag == "" {
+		return
+	}
+	actual, err := c.remoteDigest(ctx, pushed.TagRef())
+	if err != nil || actual == "" || actual == targetRef.Digest {
+		return
+	}
+	// An incomplete index keeps a platform under the tag until other nodes complete it
+	if sourceRef, err := ParseImageRef(sourceImage); err == nil {
+		sourceRef.Digest = targetRef.Digest
+		sourceRef.FullRef = sourceRef.String()
+		if c.isPartialIndex(ctx, sourceRef, targetRef, actual) {
+			return
+		}
+	}
+
+	c.logger.Warn().
+		Str("image", sourceImage).
+		Str("target", pushed.TagRef()).
+		Str("expected_digest", targetRef.Digest).
+		Str("digest", actual).
+		Msg("Restored image does not reproduce the original digest")
+	c.recoverWorkloads(ctx, sourceImage, pushed, actual)
+}
+
+// recoverWorkloads asks the recoverer to point workloads that pin sourceImage by digest at the
+// restored content, pushed under the tag of pushed with the given digest
+func (c *Client) recoverWorkloads(ctx context.Context, sourceImage string, pushed *ImageRef, digest string) {
+	if c.recoverer == nil {
+		return
+	}
+	// Workloads that only name a tag pull the restored content as is
+	spec, err := ParseImageRef(sourceImage)
+	if err != nil || spec.Digest == "" {
+		return
+	}
+
+	restored := &ImageRef{Registry: pushed.Registry, Repository: pushed.Repository, Tag: pushed.Tag, Digest: digest}
+	if err := c.recoverer.Recover(ctx, sourceImage, restored.String()); err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("image", sourceImage).
+			Str("restored", restored.String()).
+			Msg("Failed to recover workloads pinned to the original digest")
+		metrics.WorkloadRecoveries.WithLabelValues("error").Inc()
+		return
+	}
+	metrics.WorkloadRecoveries.WithLabelValues("recovered").Inc()
+}
@@ -0,0 +1,217 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// runtimeProbeTimeout bounds each attempt to identify the runtime behind a socket
+const runtimeProbeTimeout = 3 * time.Second
+
+// ErrRuntimeUnidentified is returned when a socket exists but does not answer any known runtime API
+var ErrRuntimeUnidentified = errors.New("container runtime could not be identified")
+
+// RuntimeInfo describes the container runtime found on the node
+type RuntimeInfo struct {
+	Type       RuntimeType `json:"type"`
+	Name       string      `json:"name"`
+	Version    string      `json:"version"`
+	APIVersion string      `json:"apiVersion,omitempty"`
+	SocketPath string      `json:"socketPath"`
+	// Source tells how the runtime was identified: cri, containerd, docker_api or node_status
+	Source string `json:"source"`
+}
+
+// DetectRuntime finds the container runtime socket and asks it which runtime and version it is.
+// If socketPath is empty, common socket locations are tried in order. When a socket is found but
+// cannot be identified, the returned info carries its path together with ErrRuntimeUnidentified.
+func DetectRuntime(ctx context.Context, socketPath string, logger zerolog.Logger) (RuntimeInfo, error) {
+	if socketPath != "" {
+		if _, err := os.Stat(socketPath); err != nil {
+			return RuntimeInfo{}, fmt.Errorf("configured socket path does not exist: %s", socketPath)
+		}
+	} else {
+		logger.Info().Msg("Auto-detecting container runtime socket path...")
+		for _, path := range commonSocketPaths {
+			if _, err := os.Stat(path); err == nil {
+				socketPath = path
+				break
+			}
+		}
+		if socketPath == "" {
+			return RuntimeInfo{}, fmt.Errorf("failed to auto-detect container runtime socket. Tried paths: %v. "+
+				"Please set CONTAINERD_SOCKET_PATH environment variable or use --set containerd.socketPath in Helm",
+				commonSocketPaths)
+		}
+	}
+
+	info, err := probeRuntime(ctx, socketPath)
+	if err != nil {
+		return RuntimeInfo{SocketPath: socketPath}, err
+	}
+
+	logger.Info().
+		Str("socket", info.SocketPath).
+		Str("runtime", string(info.Type)).
+		Str("version", info.Version).
+		Str("source", info.Source).
+		Msg("Detected container runtime")
+	return info, nil
+}
+
+// probeRuntime identifies the runtime behind a socket through the CRI, containerd and Docker APIs in turn
+func probeRuntime(ctx context.Context, socketPath string) (RuntimeInfo, error) {
+	var errs []error
+	for _, probe := range []func(context.Context, string) (RuntimeInfo, error){probeCRI, probeContainerd, probeDockerAPI} {
+		probeCtx, cancel := context.WithTimeout(ctx, runtimeProbeTimeout)
+		info, err := probe(probeCtx, socketPath)
+		cancel()
+		if err == nil {
+			info.SocketPath = socketPath
+			return info, nil
+		}
+		errs = append(errs, err)
+	}
+	return RuntimeInfo{}, fmt.Errorf("%w: %s: %w", ErrRuntimeUnidentified, socketPath, errors.Join(errs...))
+}
+
+// probeCRI asks a CRI runtime service for its name and version
+func probeCRI(ctx context.Context, socketPath string) (RuntimeInfo, error) {
+	conn, err := dialUnix(socketPath)
+	if err != nil {
+		return RuntimeInfo{}, err
+	}
+	defer conn.Close()
+
+	resp, err := criapi.NewRuntimeServiceClient(conn).Version(ctx, &criapi.VersionRequest{})
+	if err != nil {
+		return RuntimeInfo{}, fmt.Errorf("CRI version: %w", err)
+	}
+
+	runtime, err := runtimeTypeFromName(resp.RuntimeName)
+	if err != nil {
+		return RuntimeInfo{}, err
+	}
+	return RuntimeInfo{
+		Type:       runtime,
+		Name:       resp.RuntimeName,
+		Version:    resp.RuntimeVersion,
+		APIVersion: resp.RuntimeApiVersion,
+		Source:     "cri",
+	}, nil
+}
+
+// probeContainerd asks containerd's own version service, for nodes where the CRI plugin is disabled
+func probeContainerd(ctx context.Context, socketPath string) (RuntimeInfo, error) {
+	conn, err := dialUnix(socketPath)
+	if err != nil {
+		return RuntimeInfo{}, err
+	}
+	defer conn.Close()
+
+	resp, err := versionapi.NewVersionClient(conn).Version(ctx, &emptypb.Empty{})
+	if err != nil {
+		return RuntimeInfo{}, fmt.Errorf("containerd version: %w", err)
+	}
+	return RuntimeInfo{
+		Type:    RuntimeContainerd,
+		Name:    string(RuntimeContainerd),
+		Version: resp.Version,
+		Source:  "containerd",
+	}, nil
+}
+
+// probeDockerAPI asks the Docker Engine API, which Podman also serves, for its version
+func probeDockerAPI(ctx context.Context, socketPath string) (RuntimeInfo, error) {
+	dc := newDockerClient(socketPath)
+	defer dc.Close()
+
+	resp, err := dc.get(ctx, "get version", "", "/version", nil)
+	if err != nil {
+		return RuntimeInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	var version struct {
+		Version    string `json:"Version"`
+		APIVersion string `json:"ApiVersion"`
+		Components []struct {
+			Name string `json:"Name"`
+		} `json:"Components"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return RuntimeInfo{}, fmt.Errorf("docker version: %w", err)
+	}
+
+	info := RuntimeInfo{
+		Type:       RuntimeDocker,
+		Name:       string(RuntimeDocker),
+		Version:    version.Version,
+		APIVersion: version.APIVersion,
+		Source:     "docker_api",
+	}
+	for _, component := range version.Components {
+		if strings.Contains(strings.ToLower(component.Name), "podman") {
+			info.Type = RuntimePodman
+			info.Name = string(RuntimePodman)
+		}
+	}
+	return info, nil
+}
+
+// RuntimeFromNodeStatus identifies the runtime from a node's status.nodeInfo.containerRuntimeVersion,
+// e.g. containerd://1.7.13 or cri-o://1.30.2
+func RuntimeFromNodeStatus(socketPath, containerRuntimeVersion string) (RuntimeInfo, error) {
+	runtimeName, version, ok := strings.Cut(containerRuntimeVersion, "://")
+	if !ok {
+		return RuntimeInfo{}, fmt.Errorf("unexpected container runtime version: %q", containerRuntimeVersion)
+	}
+
+	runtime, err := runtimeTypeFromName(runtimeName)
+	if err != nil {
+		return RuntimeInfo{}, err
+	}
+	return RuntimeInfo{
+		Type:       runtime,
+		Name:       runtimeName,
+		Version:    version,
+		SocketPath: socketPath,
+		Source:     "node_status",
+	}, nil
+}
+
+// runtimeTypeFromName maps the runtime names reported by CRI and kubelet to a RuntimeType
+func runtimeTypeFromName(runtimeName string) (RuntimeType, error) {
+	switch strings.ToLower(runtimeName) {
+	case "containerd":
+		return RuntimeContainerd, nil
+	case "cri-o", "crio":
+		return RuntimeCRIO, nil
+	case "docker":
+		return RuntimeDocker, nil
+	case "podman":
+		return RuntimePodman, nil
+	default:
+		return "", fmt.Errorf("unsupported container runtime: %s", runtimeName)
+	}
+}
+
+// dialUnix creates a gRPC client for a unix socket
+func dialUnix(socketPath string) (*grpc.ClientConn, error) {
+	return grpc.NewClient("unix://"+socketPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithAuthority("localhost"),
+	)
+}
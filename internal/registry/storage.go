@@ -0,0 +1,294 @@
+package registry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/stream"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
+	"github.com/vbatts/tar-split/tar/asm"
+	tarstorage "github.com/vbatts/tar-split/tar/storage"
+)
+
+// DefaultContainersStoragePath is where the host's containers/storage is mounted into the pod
+const DefaultContainersStoragePath = "/host/var/lib/containers/storage"
+
+// storageImage is an image record of containers/storage (overlay-images/images.json)
+type storageImage struct {
+	ID           string   `json:"id"`
+	TopLayer     string   `json:"layer"`
+	BigDataNames []string `json:"big-data-names"`
+}
+
+// storageLayer is a layer record of containers/storage (overlay-layers/layers.json)
+type storageLayer struct {
+	ID     string `json:"id"`
+	Parent string `json:"parent"`
+}
+
+// containersStorage reads images from a containers/storage overlay store as used by CRI-O and Podman
+type containersStorage struct {
+	root string
+}
+
+// image returns the image record with the given ID
+func (s *containersStorage) image(id string) (*storageImage, error) {
+	var images []storageImage
+	if err := readJSONFile(filepath.Join(s.root, "overlay-images", "images.json"), &images); err != nil {
+		return nil, err
+	}
+	for i := range images {
+		if images[i].ID == id {
+			return &images[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: image %s not found in containers/storage", ErrImageNotPresent, id)
+}
+
+// layers returns the layers of an image from the base layer up
+func (s *containersStorage) layers(topLayer string) ([]storageLayer, error) {
+	var all []storageLayer
+	if err := readJSONFile(filepath.Join(s.root, "overlay-layers", "layers.json"), &all); err != nil {
+		return nil, err
+	}
+	byID := make(map[string]storageLayer, len(all))
+	for _, layer := range all {
+		byID[layer.ID] = layer
+	}
+
+	var chain []storageLayer
+	for id := topLayer; id != ""; {
+		layer, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("%w: layer %s not found in containers/storage", ErrContentNotFound, id)
+		}
+		chain = append([]storageLayer{layer}, chain...)
+		id = layer.Parent
+	}
+	return chain, nil
+}
+
+// bigData reads an item stored alongside an image, such as its manifest or config
+func (s *containersStorage) bigData(imageID, key string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.root, "overlay-images", imageID, bigDataFileName(key)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s of image %s: %v", ErrContentNotFound, key, imageID, err)
+	}
+	return data, nil
+}
+
+// layerTar reassembles the original uncompressed tar of a layer from its diff directory and tar-split metadata
+func (s *containersStorage) layerTar(layerID string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.root, "overlay-layers", layerID+".tar-split.gz"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: tar-split of layer %s: %v", ErrContentNotFound, layerID, err)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read tar-split of layer %s: %w", layerID, err)
+	}
+
+	diffDir := filepath.Join(s.root, "overlay", layerID, "diff")
+	rc := asm.NewOutputTarStream(tarstorage.NewPathFileGetter(diffDir), tarstorage.NewJSONUnpacker(gz))
+	return &multiCloser{ReadCloser: rc, closers: []io.Closer{gz, f}}, nil
+}
+
+// bigDataFileName mirrors how containers/storage names big data files:
+// keys made only of [0-9a-z.] are used as is, others are base64-encoded with a "=" prefix
+func bigDataFileName(key string) string {
+	for _, ch := range key {
+		if ch != '.' && (ch < '0' || ch > '9') && (ch < 'a' || ch > 'z') {
+			return "=" + base64.StdEncoding.EncodeToString([]byte(key))
+		}
+	}
+	return key
+}
+
+// readJSONFile decodes a JSON file
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// multiCloser closes additional resources after the wrapped reader
+type multiCloser struct {
+	io.ReadCloser
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	err := m.ReadCloser.Close()
+	for _, c := range m.closers {
+		c.Close()
+	}
+	return err
+}
+
+// pushFromContainersStorage pushes an image stored by CRI-O in containers/storage.
+// Layers whose original compressed blob is already in the target are referenced as is, other layers
+// are reassembled from the overlay store and compressed on the fly. The original manifest, and thus
+// the original digest, is kept when no layer had to be recompressed.
+func (c *Client) pushFromContainersStorage(ctx context.Context, imageName, targetImage string) error {
+	if c.cri == nil {
+		return fmt.Errorf("CRI client is not initialized")
+	}
+
+	status, err := c.cri.ImageStatus(ctx, imageName)
+	if err != nil {
+		return err
+	}
+	store := &containersStorage{root: c.containersStorage}
+	image, err := store.image(strings.TrimPrefix(status.Id, "sha256:"))
+	if err != nil {
+		return err
+	}
+
+	manifestRaw, manifest, err := store.manifest(image)
+	if err != nil {
+		return err
+	}
+	layers, err := store.layers(image.TopLayer)
+	if err != nil {
+		return err
+	}
+	if len(layers) != len(manifest.Layers) {
+		return fmt.Errorf("image %s has %d layers in storage but %d in its manifest", imageName, len(layers), len(manifest.Layers))
+	}
+
+	ref, err := c.parseReference(targetImage)
+	if err != nil {
+		return fmt.Errorf("failed to parse reference: %w", err)
+	}
+	checker, err := c.newBlobChecker(ctx, ref.Context())
+	if err != nil {
+		return err
+	}
+
+	config, err := store.bigData(image.ID, manifest.Config.Digest.String())
+	if err != nil {
+		return err
+	}
+	configLayer, err := partial.CompressedToLayer(&archiveBlob{
+		digest:    manifest.Config.Digest,
+		size:      int64(len(config)),
+		mediaType: manifest.Config.MediaType,
+		r:         bytes.NewReader(config),
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.writeBlob(ctx, checker, configLayer); err != nil {
+		return fmt.Errorf("failed to push image config: %w", err)
+	}
+
+	rewritten := false
+	for i, layer := range layers {
+		original := manifest.Layers[i]
+		exists, err := checker.exists(ctx, original.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to check blob %s: %w", original.Digest, err)
+		}
+		if exists {
+			metrics.RestoreBlobBytes.WithLabelValues(c.targetRegistry, "skipped").Add(float64(original.Size))
+			continue
+		}
+
+		desc, err := c.uploadStorageLayer(ctx, checker, store, layer, original.MediaType)
+		if err != nil {
+			return err
+		}
+		manifest.Layers[i] = desc
+		rewritten = rewritten || desc.Digest != original.Digest
+	}
+
+	if rewritten {
+		c.logger.Info().
+			Str("image", imageName).
+			Str("target", targetImage).
+			Msg("Layers were recompressed from containers/storage, the restored image has a new digest")
+		if manifestRaw, err = json.Marshal(manifest); err != nil {
+			return err
+		}
+	}
+
+	// OCI manifests need not carry their media type, and Docker manifests always do
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = types.OCIManifestSchema1
+	}
+	if err := remote.Put(ref, &rawManifest{raw: manifestRaw, mediaType: mediaType}, c.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("failed to push image to registry: %w", err)
+	}
+	return nil
+}
+
+// manifest returns the stored image manifest of an image, skipping manifest lists
+func (s *containersStorage) manifest(image *storageImage) ([]byte, *v1.Manifest, error) {
+	for _, key := range image.BigDataNames {
+		if !strings.HasPrefix(key, "manifest") {
+			continue
+		}
+		raw, err := s.bigData(image.ID, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Manifest lists parse without a config and are skipped
+		manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+		if err != nil || manifest.Config.Digest.Hex != image.ID {
+			continue
+		}
+		return raw, manifest, nil
+	}
+	return nil, nil, fmt.Errorf("%w: no manifest stored for image %s", ErrContentNotFound, image.ID)
+}
+
+// uploadStorageLayer reassembles, compresses and uploads a layer of containers/storage
+func (c *Client) uploadStorageLayer(ctx context.Context, checker *blobChecker, store *containersStorage, layer storageLayer, mediaType types.MediaType) (v1.Descriptor, error) {
+	rc, err := store.layerTar(layer.ID)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	// The layer is recompressed with gzip whatever compression it was pulled with, e.g. zstd
+	if strings.HasPrefix(string(mediaType), "application/vnd.oci.") {
+		mediaType = types.OCILayer
+	} else {
+		mediaType = types.DockerLayer
+	}
+	streamed := stream.NewLayer(rc, stream.WithMediaType(mediaType))
+	if err := remote.WriteLayer(checker.repo, streamed, c.remoteOptions(ctx)...); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to push layer %s: %w", layer.ID, err)
+	}
+
+	digest, err := streamed.Digest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	size, err := streamed.Size()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	metrics.RestoreBlobBytes.WithLabelValues(c.targetRegistry, "uploaded").Add(float64(size))
+	checker.pushed[digest] = struct{}{}
+
+	return v1.Descriptor{MediaType: mediaType, Digest: digest, Size: size}, nil
+}
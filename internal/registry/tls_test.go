@@ -0,0 +1,261 @@
+package registry_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	ggcrregistry "github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rs/zerolog"
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/registry"
+)
+
+// testRegistryHost is the name the test registry is reached under. Loopback hosts are always
+// talked to over plain HTTP, and the httptest certificate is also valid for example.com.
+const testRegistryHost = "example.com"
+
+// dialTransport returns an HTTP transport that resolves every host to the server
+func dialTransport(srv *httptest.Server) *http.Transport {
+	rt := http.DefaultTransport.(*http.Transport).Clone()
+	addr := srv.Listener.Addr().String()
+	rt.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return rt
+}
+
+// newTLSTestClient returns a client with the TLS settings for a registry stand-in served by srv
+func newTLSTestClient(t *testing.T, srv *httptest.Server, settings registry.RegistryTLS) (*registry.Client, string) {
+	t.Helper()
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := net.JoinHostPort(testRegistryHost, port)
+
+	client, err := registry.NewClient(host, "user", "password", "", registry.RuntimeType(""), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	client.SetTransport(dialTransport(srv))
+	if err := client.SetRegistryTLS(map[string]registry.RegistryTLS{host: settings}); err != nil {
+		t.Fatalf("SetRegistryTLS() error = %v", err)
+	}
+	return client, host
+}
+
+// newTestRegistry returns an in-memory registry that does not log requests
+func newTestRegistry() http.Handler {
+	return ggcrregistry.New(ggcrregistry.Logger(log.New(io.Discard, "", 0)))
+}
+
+// writePEM writes PEM blocks of the given type to a file in dir
+func writePEM(t *testing.T, dir, file, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, file)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeServerCA writes the certificate of a TLS test server as a CA bundle
+func writeServerCA(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	return writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+}
+
+// writeClientCert writes a self-signed client certificate and its key
+func writeClientCert(t *testing.T) (*x509.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "syncer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	return cert, writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+// pushRandomImage writes a random image to the registry served by srv, presenting certs if it asks for them
+func pushRandomImage(t *testing.T, srv *httptest.Server, image string, certs ...tls.Certificate) {
+	t.Helper()
+
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := dialTransport(srv)
+	var opts []name.Option
+	if srv.TLS == nil {
+		opts = append(opts, name.Insecure)
+	} else {
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		rt.TLSClientConfig = &tls.Config{RootCAs: roots, Certificates: certs, MinVersion: tls.VersionTLS12}
+	}
+	ref, err := name.ParseReference(image, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img, remote.WithTransport(rt)); err != nil {
+		t.Fatalf("remote.Write() error = %v", err)
+	}
+}
+
+func TestRegistryTLSCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(newTestRegistry())
+	defer srv.Close()
+	ctx := context.Background()
+
+	untrusted, host := newTLSTestClient(t, srv, registry.RegistryTLS{})
+	image := host + "/team/app:v1"
+	if _, err := untrusted.ImageExists(ctx, image); !errors.Is(err, registry.ErrRegistryTLS) {
+		t.Fatalf("ImageExists() without CA error = %v, want ErrRegistryTLS", err)
+	}
+
+	client, _ := newTLSTestClient(t, srv, registry.RegistryTLS{CAFile: writeServerCA(t, srv)})
+	exists, err := client.ImageExists(ctx, image)
+	if err != nil || exists {
+		t.Fatalf("ImageExists() before push = %v, %v, want false, nil", exists, err)
+	}
+	pushRandomImage(t, srv, image)
+	exists, err = client.ImageExists(ctx, image)
+	if err != nil || !exists {
+		t.Fatalf("ImageExists() after push = %v, %v, want true, nil", exists, err)
+	}
+
+	skipVerify, _ := newTLSTestClient(t, srv, registry.RegistryTLS{InsecureSkipVerify: true})
+	if exists, err := skipVerify.ImageExists(ctx, image); err != nil || !exists {
+		t.Fatalf("ImageExists() with insecureSkipVerify = %v, %v, want true, nil", exists, err)
+	}
+}
+
+func TestRegistryTLSClientCertificate(t *testing.T) {
+	cert, certFile, keyFile := writeClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+
+	srv := httptest.NewUnstartedServer(newTestRegistry())
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := writeServerCA(t, srv)
+	ctx := context.Background()
+
+	anonymous, host := newTLSTestClient(t, srv, registry.RegistryTLS{CAFile: caFile})
+	image := host + "/team/app:v1"
+	if _, err := anonymous.ImageExists(ctx, image); err == nil {
+		t.Fatal("ImageExists() without client certificate succeeded, want an error")
+	}
+
+	client, _ := newTLSTestClient(t, srv, registry.RegistryTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushRandomImage(t, srv, image, clientCert)
+	if exists, err := client.ImageExists(ctx, image); err != nil || !exists {
+		t.Fatalf("ImageExists() with client certificate = %v, %v, want true, nil", exists, err)
+	}
+}
+
+func TestRegistryTLSPlainHTTP(t *testing.T) {
+	srv := httptest.NewServer(newTestRegistry())
+	defer srv.Close()
+	ctx := context.Background()
+
+	https, host := newTLSTestClient(t, srv, registry.RegistryTLS{})
+	image := host + "/team/app:v1"
+	if _, err := https.ImageExists(ctx, image); !errors.Is(err, registry.ErrRegistryTLS) {
+		t.Fatalf("ImageExists() over HTTPS error = %v, want ErrRegistryTLS", err)
+	}
+
+	client, _ := newTLSTestClient(t, srv, registry.RegistryTLS{PlainHTTP: true})
+	pushRandomImage(t, srv, image)
+	if exists, err := client.ImageExists(ctx, image); err != nil || !exists {
+		t.Fatalf("ImageExists() over plain HTTP = %v, %v, want true, nil", exists, err)
+	}
+}
+
+func TestRegistryTLSInvalidSettings(t *testing.T) {
+	_, certFile, keyFile := writeClientCert(t)
+	emptyCA := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(emptyCA, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		settings registry.RegistryTLS
+		wantErr  string
+	}{
+		{name: "missing CA file", settings: registry.RegistryTLS{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, wantErr: "failed to read CA bundle"},
+		{name: "CA file without certificates", settings: registry.RegistryTLS{CAFile: emptyCA}, wantErr: "no certificates found"},
+		{name: "certificate without key", settings: registry.RegistryTLS{CertFile: certFile}, wantErr: "must be set together"},
+		{name: "key without certificate", settings: registry.RegistryTLS{KeyFile: keyFile}, wantErr: "must be set together"},
+		{name: "key that does not match", settings: registry.RegistryTLS{CertFile: certFile, KeyFile: certFile}, wantErr: "failed to load client certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := registry.NewClient("registry.example.com", "", "", "", registry.RuntimeType(""), zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = client.SetRegistryTLS(map[string]registry.RegistryTLS{"registry.example.com": tt.settings})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("SetRegistryTLS() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
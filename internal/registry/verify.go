@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
+)
+
+// VerifyMode controls how content in the target registry is verified against what runs in the cluster
+type VerifyMode string
+
+const (
+	// VerifyOff only checks that the target reference exists
+	VerifyOff VerifyMode = "off"
+	// VerifyReport compares digests and reports drift without touching the registry
+	VerifyReport VerifyMode = "report"
+	// VerifyRepair compares digests, reports drift and pushes the running content by digest when the
+	// target lacks it; tags are only written when they are missing, never moved back
+	VerifyRepair VerifyMode = "repair"
+)
+
+// EventRecorder publishes Kubernetes events about sync results
+type EventRecorder interface {
+	Event(eventType, reason, message string)
+}
+
+// SetVerifyMode sets how target content is verified
+func (c *Client) SetVerifyMode(mode VerifyMode) {
+	c.verifyMode = mode
+}
+
+// SetEventRecorder enables Kubernetes events about sync results
+func (c *Client) SetEventRecorder(recorder EventRecorder) {
+	c.recorder = recorder
+}
+
+// verifyTarget reports whether the target already holds the right content and the sync can be skipped.
+// Unless verification is off, the digest the target resolves to is compared with the digest that
+// runs in the cluster: the pod's ImageID or, for target registry images, the local runtime's digest.
+// When that digest was not known yet it is recorded on sourceRef and targetRef.
+func (c *Client) verifyTarget(ctx context.Context, sourceImage string, sourceRef, targetRef *ImageRef) (bool, error) {
+	if c.verifyMode == VerifyOff || c.verifyMode == "" {
+		ref := *targetRef
+		if ref.Tag != "" {
+			ref.Digest = ""
+		}
+		return c.ImageExists(ctx, ref.String())
+	}
+
+	if targetRef.Digest == "" && c.IsTargetImage(sourceImage) {
+		if runtimeImage, err := RuntimeImageName(sourceImage); err == nil {
+			digest, err := c.LocalImageDigest(ctx, runtimeImage)
+			if err != nil {
+				c.logger.Debug().
+					Err(err).
+					Str("image", runtimeImage).
+					Msg("Failed to look up local image digest")
+			}
+			if digest != "" {
+				sourceRef.Digest = digest
+				sourceRef.FullRef = sourceRef.String()
+				targetRef.Digest = digest
+				targetRef.FullRef = targetRef.String()
+			}
+		}
+	}
+
+	actual, err := c.remoteDigest(ctx, targetRef.PushRef())
+	if err != nil {
+		return false, err
+	}
+	if actual == "" {
+		return false, nil
+	}
+	if targetRef.Digest == "" || actual == targetRef.Digest {
+		return true, nil
+	}
+	// A reconstructed image never matches the running digest, it records it instead
+	if c.reconstructedFrom(ctx, targetRef.PushRef()) == targetRef.Digest {
+		return true, nil
+	}
+
+	// A single platform stands in for an incomplete index, the restore goes on to complete it
+	if c.isPartialIndex(ctx, sourceRef, targetRef, actual) {
+		return false, nil
+	}
+
+	// The tag moved on, e.g. in a rolling update; only the running content itself can be missing
+	present, err := c.remoteDigest(ctx, targetRef.DigestRef())
+	if err != nil {
+		return false, err
+	}
+	if present != "" || c.verifyMode == VerifyReport {
+		c.reportDrift(sourceImage, targetRef, actual, "reported")
+		return true, nil
+	}
+	c.reportDrift(sourceImage, targetRef, actual, "repaired")
+	return false, nil
+}
+
+// reportDrift records that the target tag points to different content than what runs in the cluster
+func (c *Client) reportDrift(sourceImage string, targetRef *ImageRef, actual, action string) {
+	c.logger.Warn().
+		Str("image", sourceImage).
+		Str("target", targetRef.TagRef()).
+		Str("running_digest", targetRef.Digest).
+		Str("target_digest", actual).
+		Str("action", action).
+		Msg("Target registry content differs from the running image")
+	metrics.ImageDigestDrift.WithLabelValues(c.targetRegistry, action).Inc()
+
+	if c.recorder != nil {
+		c.recorder.Event("Warning", "ImageDigestDrift", fmt.Sprintf(
+			"%s resolves to %s but %s runs %s (%s)",
+			targetRef.TagRef(), actual, sourceImage, targetRef.Digest, action))
+	}
+}
@@ -2,6 +2,7 @@ package syncer
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -12,21 +13,66 @@ import (
 	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/registry"
 )
 
+// watchWorkers is the number of workers syncing images queued by watch events
+const watchWorkers = 5
+
+// Target is a registry the syncer mirrors images to
+type Target struct {
+	Name   string
+	Client *registry.Client
+	// Concurrency limits how many images are synced to this registry at the same time
+	Concurrency int
+}
+
+// TargetResult is the outcome of syncing an image to one target
+type TargetResult struct {
+	Target string
+	Err    error
+}
+
+// target is a Target with the semaphore enforcing its concurrency, shared by all sync paths
+type target struct {
+	Target
+	semaphore chan struct{}
+}
+
 // Syncer manages the image synchronization process
 type Syncer struct {
-	config         *config.Config
-	k8sClient      *k8s.Client
-	registryClient *registry.Client
-	logger         zerolog.Logger
+	config    *config.Config
+	k8sClient *k8s.Client
+	targets   []*target
+	discovery k8s.DiscoveryOptions
+	logger    zerolog.Logger
 }
 
-// New creates a new Syncer instance
-func New(cfg *config.Config, k8sClient *k8s.Client, registryClient *registry.Client, logger zerolog.Logger) *Syncer {
+// New creates a new Syncer instance mirroring images to the given targets
+func New(cfg *config.Config, k8sClient *k8s.Client, targets []Target, logger zerolog.Logger) *Syncer {
+	kinds := make([]k8s.WorkloadKind, 0, len(cfg.WorkloadKinds))
+	for _, kind := range cfg.WorkloadKinds {
+		kinds = append(kinds, k8s.WorkloadKind(kind))
+	}
+
+	discovery := k8s.DiscoveryOptions{
+		Namespaces:  cfg.Namespaces,
+		Mode:        k8s.DiscoveryMode(cfg.DiscoveryMode),
+		Kinds:       kinds,
+		Deployments: cfg.Deployments,
+	}
+	if cfg.NodeLocalOnly {
+		discovery.NodeName = cfg.NodeName
+	}
+
+	syncTargets := make([]*target, 0, len(targets))
+	for _, t := range targets {
+		syncTargets = append(syncTargets, &target{Target: t, semaphore: make(chan struct{}, t.Concurrency)})
+	}
+
 	return &Syncer{
-		config:         cfg,
-		k8sClient:      k8sClient,
-		registryClient: registryClient,
-		logger:         logger,
+		config:    cfg,
+		k8sClient: k8sClient,
+		targets:   syncTargets,
+		discovery: discovery,
+		logger:    logger,
 	}
 }
 
@@ -35,8 +81,29 @@ func (s *Syncer) Run(ctx context.Context) error {
 	s.logger.Info().
 		Dur("sync_period", s.config.SyncPeriod).
 		Strs("namespaces", s.config.Namespaces).
+		Strs("workload_kinds", s.config.WorkloadKinds).
+		Str("discovery_mode", s.config.DiscoveryMode).
+		Str("node", s.config.NodeName).
+		Int("targets", len(s.targets)).
+		Bool("node_local_only", s.config.NodeLocalOnly).
+		Bool("watch", s.config.WatchEnabled).
+		Bool("watch_pull_failures", s.config.WatchPullFailures).
 		Msg("Starting image synchronization service")
 
+	// React to new images right away; the periodic full sync stays as a safety net
+	if s.config.WatchEnabled {
+		if err := s.startWatch(ctx); err != nil {
+			s.logger.Error().Err(err).Msg("Failed to start watching cluster, relying on periodic sync only")
+		}
+	}
+
+	// Restore images of pods stuck in ErrImagePull/ImagePullBackOff without waiting for a cycle
+	if s.config.WatchPullFailures {
+		if err := s.startPullFailureWatch(ctx); err != nil {
+			s.logger.Error().Err(err).Msg("Failed to start watching image pull failures")
+		}
+	}
+
 	ticker := time.NewTicker(s.config.SyncPeriod)
 	defer ticker.Stop()
 
@@ -68,7 +135,7 @@ func (s *Syncer) syncOnce(ctx context.Context) error {
 	s.logger.Info().Msg("Starting sync cycle")
 
 	// Get all images from Kubernetes
-	images, err := s.k8sClient.GetAllImages(ctx, s.config.Namespaces, s.config.Deployments)
+	images, err := s.k8sClient.GetAllImages(ctx, s.discovery)
 	if err != nil {
 		return err
 	}
@@ -85,7 +152,19 @@ func (s *Syncer) syncOnce(ctx context.Context) error {
 		Msg("Found images to process")
 
 	// Process images with concurrency control
-	s.syncImages(ctx, images)
+	failed := s.syncImages(ctx, images)
+	for _, t := range s.targets {
+		event := s.logger.Info()
+		if failed[t.Name] > 0 {
+			event = s.logger.Warn()
+		}
+		event.
+			Str("target", t.Name).
+			Str("registry", t.Client.TargetRegistry()).
+			Int("images", len(images)).
+			Int("failed", failed[t.Name]).
+			Msg("Target sync results")
+	}
 
 	s.logger.Info().
 		Dur("duration", time.Since(start)).
@@ -94,68 +173,191 @@ func (s *Syncer) syncOnce(ctx context.Context) error {
 	return nil
 }
 
-// syncImages syncs multiple images with concurrency control
-func (s *Syncer) syncImages(ctx context.Context, images []string) {
+// syncImages syncs multiple images to all targets and returns the number of failures per target
+func (s *Syncer) syncImages(ctx context.Context, images []k8s.Image) map[string]int {
 	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 5) // Max 5 concurrent syncs
+	var mu sync.Mutex
+	failed := make(map[string]int, len(s.targets))
 
 	for _, image := range images {
 		wg.Add(1)
-		go func(img string) {
+		go func(img k8s.Image) {
 			defer wg.Done()
+			for _, result := range s.syncImage(ctx, img) {
+				if result.Err != nil {
+					mu.Lock()
+					failed[result.Target]++
+					mu.Unlock()
+				}
+			}
+		}(image)
+	}
+
+	wg.Wait()
+	return failed
+}
+
+// syncImage syncs an image to every target concurrently, each within its own concurrency
+// limit, and reports the outcome for each target
+func (s *Syncer) syncImage(ctx context.Context, image k8s.Image) []TargetResult {
+	results := make([]TargetResult, len(s.targets))
+	var wg sync.WaitGroup
 
-			// Acquire semaphore
+	for i, t := range s.targets {
+		results[i].Target = t.Name
+		wg.Add(1)
+		go func(i int, t *target) {
+			defer wg.Done()
+
+			// Acquire the target's semaphore, shared with watch workers
 			select {
-			case semaphore <- struct{}{}:
-				defer func() { <-semaphore }()
+			case t.semaphore <- struct{}{}:
+				defer func() { <-t.semaphore }()
 			case <-ctx.Done():
+				results[i].Err = ctx.Err()
 				return
 			}
 
 			// Sync with retries
-			if err := s.syncImageWithRetry(ctx, img); err != nil {
+			if err := s.syncImageWithRetry(ctx, t, image); err != nil {
 				s.logger.Error().
 					Err(err).
-					Str("image", img).
+					Str("image", image.Name).
+					Str("digest", image.Digest).
+					Str("target", t.Name).
 					Msg("Failed to sync image after retries")
+				results[i].Err = err
 			}
-		}(image)
+		}(i, t)
 	}
 
 	wg.Wait()
+	return results
 }
 
-// syncImageWithRetry syncs a single image with retry logic
-func (s *Syncer) syncImageWithRetry(ctx context.Context, image string) error {
+// syncImageWithRetry syncs a single image to a target with retry logic
+func (s *Syncer) syncImageWithRetry(ctx context.Context, t *target, image k8s.Image) error {
 	var lastErr error
+	delay := s.config.RetryDelay
+	// backoff grows only while a registry keeps rate limiting without a Retry-After
+	backoff := s.config.RetryDelay
 
 	for attempt := 0; attempt <= s.config.MaxRetries; attempt++ {
 		if attempt > 0 {
 			s.logger.Info().
-				Str("image", image).
+				Str("image", image.Name).
+				Str("target", t.Name).
 				Int("attempt", attempt).
 				Int("max_retries", s.config.MaxRetries).
 				Msg("Retrying image sync")
 
 			select {
-			case <-time.After(s.config.RetryDelay):
+			case <-time.After(delay):
 			case <-ctx.Done():
 				return ctx.Err()
 			}
 		}
 
-		err := s.registryClient.SyncImage(ctx, image)
+		err := s.syncAwaitingClaim(ctx, t, image)
 		if err == nil {
 			return nil
 		}
 
+		// The claim outlived its lease and the image is still missing: the holder keeps renewing
+		// the claim without completing the restore, or this process keeps restoring it
+		if errors.Is(err, registry.ErrRestoreClaimed) {
+			s.logger.Warn().
+				Str("image", image.Name).
+				Str("target", t.Name).
+				Dur("waited", s.config.LeaseDuration+s.config.RetryDelay).
+				Msg("Claimed restore did not complete while waiting for it")
+			metrics.RestoreClaims.WithLabelValues("unfinished").Inc()
+			return err
+		}
+
+		// Another node holds this image or its content; retrying here cannot succeed
+		if errors.Is(err, registry.ErrImageNotPresent) || errors.Is(err, registry.ErrContentNotFound) {
+			return nil
+		}
+
+		// The mapping rules send another image to the same target repository until they are fixed,
+		// and the missing platforms of an index can only come from nodes that run them
+		if errors.Is(err, registry.ErrMappingConflict) || errors.Is(err, registry.ErrIncompleteIndex) {
+			return err
+		}
+
 		lastErr = err
+		delay = s.config.RetryDelay
+
+		var registryErr *registry.RegistryError
+		if errors.As(err, &registryErr) {
+			metrics.RegistryErrors.WithLabelValues(registryErr.Registry, registryErr.Reason()).Inc()
+			switch registryErr.Kind {
+			case registry.ErrRegistryNotFound:
+				// The source image is gone, retrying cannot bring it back. The target reports the
+				// same for a missing project or blob, which may well be transient.
+				if !t.Client.IsTargetImage(image.Name) && registry.SameRegistry(registryErr.Registry, registry.RegistryHost(image.Name)) {
+					s.logger.Warn().
+						Err(err).
+						Str("image", image.Name).
+						Str("target", t.Name).
+						Msg("Source image not found in registry, skipping")
+					return err
+				}
+			case registry.ErrRegistryUnauthorized, registry.ErrRegistryTLS:
+				// Credentials or certificates need fixing before any attempt can succeed
+				s.logger.Error().
+					Err(err).
+					Str("image", image.Name).
+					Str("target", t.Name).
+					Str("registry", registryErr.Registry).
+					Str("reason", registryErr.Reason()).
+					Msg("Registry rejected the sync, check its credentials and TLS settings")
+				return err
+			case registry.ErrRegistryRateLimited:
+				// Wait as long as the registry asked, or back off exponentially until it accepts requests again
+				if wait := t.Client.RetryAfter(registryErr.Registry); wait > 0 {
+					delay = wait
+				} else {
+					backoff *= 2
+					delay = backoff
+				}
+			}
+		}
+
 		s.logger.Warn().
 			Err(err).
-			Str("image", image).
+			Str("image", image.Name).
+			Str("target", t.Name).
 			Int("attempt", attempt+1).
 			Msg("Image sync attempt failed")
 	}
 
 	return lastErr
 }
+
+// syncAwaitingClaim syncs a single image to a target. While another node or worker holds the
+// restore claim it keeps checking back, without using up retries, until the claim's lease could
+// have expired: by then the holder finished and the image is skipped, or this node takes over.
+func (s *Syncer) syncAwaitingClaim(ctx context.Context, t *target, image k8s.Image) error {
+	deadline := time.Now().Add(s.config.LeaseDuration + s.config.RetryDelay)
+
+	for {
+		err := t.Client.SyncImage(ctx, image.Name, image.Digest)
+		if !errors.Is(err, registry.ErrRestoreClaimed) || time.Now().After(deadline) {
+			return err
+		}
+
+		s.logger.Debug().
+			Str("image", image.Name).
+			Str("target", t.Name).
+			Time("deadline", deadline).
+			Msg("Restore is in progress elsewhere, waiting for its claim")
+
+		select {
+		case <-time.After(s.config.RetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package syncer
+
+import (
+	"context"
+
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/k8s"
+	"github.com/tazhate/push-from-k8s-back-to-docker-registry/internal/metrics"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// pullFailureWorkers is the number of workers dedicated to restoring images of pods stuck on pulls
+const pullFailureWorkers = 2
+
+// startWatch enqueues images as soon as workloads or pods reveal them and
+// starts workers that sync queued images between full sync cycles
+func (s *Syncer) startWatch(ctx context.Context) error {
+	queue := workqueue.NewTyped[k8s.Image]()
+	go func() {
+		<-ctx.Done()
+		queue.ShutDown()
+	}()
+
+	err := s.k8sClient.WatchImages(ctx, s.discovery, func(images []k8s.Image) {
+		for _, image := range images {
+			s.logger.Debug().
+				Str("image", image.Name).
+				Str("digest", image.Digest).
+				Msg("Queued image from watch event")
+			queue.Add(image)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < watchWorkers; i++ {
+		go s.runWorker(ctx, queue)
+	}
+
+	return nil
+}
+
+// runWorker syncs queued images until the queue is shut down
+func (s *Syncer) runWorker(ctx context.Context, queue workqueue.TypedInterface[k8s.Image]) {
+	for {
+		image, shutdown := queue.Get()
+		if shutdown {
+			return
+		}
+		s.syncImage(ctx, image)
+		queue.Done(image)
+	}
+}
+
+// startPullFailureWatch restores images of target registry pods that fail to pull.
+// Failures are handled by dedicated workers that do not wait for the shared
+// concurrency limit, so a stuck pod is never queued behind a full sync cycle.
+func (s *Syncer) startPullFailureWatch(ctx context.Context) error {
+	queue := workqueue.NewTyped[k8s.Image]()
+	go func() {
+		<-ctx.Done()
+		queue.ShutDown()
+	}()
+
+	err := s.k8sClient.WatchPullFailures(ctx, s.config.Namespaces, func(image k8s.Image, source string) {
+		if len(s.hostingTargets(image.Name)) == 0 {
+			return
+		}
+		metrics.PullFailuresDetected.WithLabelValues(source).Inc()
+		s.logger.Info().
+			Str("image", image.Name).
+			Str("source", source).
+			Msg("Image pull failure detected, queueing immediate restore")
+		queue.Add(image)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < pullFailureWorkers; i++ {
+		go func() {
+			for {
+				image, shutdown := queue.Get()
+				if shutdown {
+					return
+				}
+				for _, t := range s.hostingTargets(image.Name) {
+					if err := s.syncImageWithRetry(ctx, t, image); err != nil {
+						s.logger.Error().
+							Err(err).
+							Str("image", image.Name).
+							Str("target", t.Name).
+							Msg("Failed to restore image after pull failure")
+					}
+				}
+				queue.Done(image)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// hostingTargets returns the targets an image is pulled from, which can only restore it
+func (s *Syncer) hostingTargets(image string) []*target {
+	var hosting []*target
+	for _, t := range s.targets {
+		if t.Client.IsTargetImage(image) {
+			hosting = append(hosting, t)
+		}
+	}
+	return hosting
+}